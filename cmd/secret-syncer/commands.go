@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sigs.k8s.io/yaml"
+	"vault-injector/config"
+	"vault-injector/internal/k8s"
+	telegram "vault-injector/pkg"
+	"vault-injector/pkg/health"
+	"vault-injector/pkg/notify"
+	"vault-injector/pkg/vault"
+)
+
+// runCommand runs a subcommand from args and returns false when args hold
+// none, so the daemon starts.
+func runCommand(cfg *config.Config, args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "validate":
+		os.Exit(validateCmd(args[1:]))
+	case "render":
+		os.Exit(renderCmd(cfg, args[1:]))
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q, expected validate or render\n", args[0])
+	os.Exit(2)
+	return true
+}
+
+// validateCmd checks a secret map without cluster or vault access.
+func validateCmd(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: secret-syncer validate <map.yaml>")
+	}
+	_ = fs.Parse(args) //nolint:errcheck
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	secretMap, err := vault.ParseMap(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s is invalid:\n%v\n", fs.Arg(0), err)
+		return 1
+	}
+	fmt.Printf("%s is valid: %d secrets\n", fs.Arg(0), len(secretMap))
+	return 0
+}
+
+// renderCmd logs in to vault and prints the secret the daemon would write.
+// Dynamic secrets and certificates are not requested, render leaves nothing
+// behind in vault but its own token, which is revoked on exit.
+func renderCmd(cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	namespace := fs.String("namespace", "", "secret namespace")
+	name := fs.String("name", "", "secret name")
+	secretMap := fs.String("map", cfg.SecretMap, "secret map file")
+	showValues := fs.Bool("show-values", false, "print secret values instead of redacting them")
+	_ = fs.Parse(args) //nolint:errcheck
+	if *namespace == "" || *name == "" {
+		fmt.Fprintln(os.Stderr, "usage: secret-syncer render --namespace X --name Y [--map map.yaml] [--show-values]")
+		return 2
+	}
+	cfg.SecretMap = *secretMap
+
+	cfg.VaultAuth.RevokeToken = true
+
+	ctx := context.Background()
+	vs := vault.NewVaultService(cfg, notify.Discard, telegram.NewTelegram(cfg), make(chan config.UpdateInterface, 1), health.NewRegistry())
+	if err := vs.Login(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer vs.Stop(ctx)
+	secret, err := k8s.RenderSecret(vault.WithReadOnly(ctx), cfg, vs, *namespace, *name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !*showValues {
+		secret.StringData = make(map[string]string, len(secret.Data))
+		for k := range secret.Data {
+			secret.StringData[k] = "<redacted>"
+		}
+		secret.Data = nil
+		// the checksum of the values is as good as the values for a short one
+		delete(secret.Annotations, cfg.SecretLabel+"/checksum")
+	}
+	b, err := yaml.Marshal(secret)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Print(string(b))
+	return 0
+}
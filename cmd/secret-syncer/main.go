@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"go.uber.org/dig"
 	"go.uber.org/zap"
@@ -14,6 +15,8 @@ import (
 	"vault-injector/internal/http"
 	"vault-injector/internal/k8s"
 	telegram "vault-injector/pkg"
+	"vault-injector/pkg/health"
+	"vault-injector/pkg/notify"
 	"vault-injector/pkg/vault"
 )
 
@@ -23,7 +26,12 @@ var (
 )
 
 func main() {
+	if runCommand(config.GetCfg(), flag.Args()) {
+		return
+	}
 	ctx, cancelFunction := context.WithCancel(context.Background())
+	// the elector outlives ctx, so the Lease is held until the queue drained
+	electCtx, cancelElection := context.WithCancel(context.Background())
 
 	container := dig.New()
 	container.Provide(config.GetCfg)                 //nolint:errcheck
@@ -33,9 +41,15 @@ func main() {
 	container.Provide(http.NewWebServer)             //nolint:errcheck
 	container.Provide(controller.NewLoopController)  //nolint:errcheck
 	container.Provide(controller.NewWatchController) //nolint:errcheck
+	container.Provide(controller.NewWorkQueue)       //nolint:errcheck
 	container.Provide(vault.NewVaultService)         //nolint:errcheck
+	container.Provide(health.NewRegistry)            //nolint:errcheck
 	container.Provide(func() chan config.UpdateInterface {
-		return make(chan config.UpdateInterface)
+		// one pending update covers any number of requests
+		return make(chan config.UpdateInterface, 1)
+	}) //nolint:errcheck
+	container.Provide(func(cfg *config.Config, telegram *telegram.Telegram) notify.Notifier {
+		return notify.New(cfg, telegram)
 	}) //nolint:errcheck
 
 	if err := container.Invoke(func(vault vault.Service) {
@@ -52,28 +66,72 @@ func main() {
 
 	info := fmt.Sprintf("vault-secret-syncer starting. Version: %s. (BuiltTime: %s)\n", version, buildTime)
 	zap.S().Info(info)
-	if err := container.Invoke(func(telegram *telegram.Telegram) {
-		telegram.SendMessage(info)
+	if err := container.Invoke(func(notifier notify.Notifier) {
+		notifier.Notify(notify.Info, info)
 	}); err != nil {
 		zap.S().Fatal(err)
 	}
 
-	defer func() {
-		zap.S().Info("Main Defer: canceling context")
-		cancelFunction()
-		time.Sleep(time.Second * 5)
-	}()
-
-	if err := container.Invoke(func(ctlList controller.List) {
-		for _, ctl := range ctlList.Controllers {
-			ctl.Start(ctx)
-		}
+	// controllers run only on the leader, the web server runs on every replica
+	leading := make(chan struct{})
+	if err := container.Invoke(func(ks k8s.KubeService, queue *controller.WorkQueue, ctlList controller.List) {
+		go func() {
+			defer close(leading)
+			ks.RunLeaderElection(electCtx, func(leaderCtx context.Context) {
+				// controllers stop on shutdown and when leadership is lost
+				runCtx, stop := context.WithCancel(leaderCtx)
+				context.AfterFunc(ctx, stop)
+				if err := ks.Start(runCtx); err != nil {
+					zap.S().Fatal(err)
+				}
+				queue.Start(runCtx, leaderCtx)
+				for _, ctl := range ctlList.Controllers {
+					ctl.Start(runCtx, queue)
+				}
+			})
+		}()
 	}); err != nil {
 		zap.S().Fatal(err)
 	}
 
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
-	sigName := <-signals
-	zap.S().Infof("Received SIGNAL - %s. Terminating...", sigName)
+	select {
+	case sigName := <-signals:
+		zap.S().Infof("Received SIGNAL - %s. Terminating...", sigName)
+	case <-leading:
+		zap.S().Warn("Leadership lost. Terminating...")
+	}
+	shutdown(container, cancelFunction, cancelElection, leading)
+}
+
+// shutdown stops within SHUTDOWN_TIMEOUT: controllers stop feeding the queue,
+// syncs in flight finish their writes while the Lease is still held, then the
+// Lease is released and the web server and vault are stopped. After a lost
+// leadership the syncs were cancelled already.
+func shutdown(container *dig.Container, cancel, cancelElection context.CancelFunc, leading chan struct{}) {
+	timeout := time.Duration(config.GetCfg().ShutdownTimeout) * time.Second
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), timeout)
+	defer cancelTimeout()
+	zap.S().Info("canceling context")
+	cancel()
+	if err := container.Invoke(func(queue *controller.WorkQueue, ctlList controller.List, webServer http.WebServer, vault vault.Service) {
+		for _, ctl := range ctlList.Controllers {
+			ctl.Wait()
+		}
+		deadline, _ := ctx.Deadline()
+		queue.Wait(time.Until(deadline))
+		cancelElection()
+		select {
+		case <-leading:
+		case <-ctx.Done():
+		}
+		if err := webServer.Stop(ctx); err != nil {
+			zap.S().Errorf("http server shutdown: %v", err)
+		}
+		vault.Stop(ctx)
+	}); err != nil {
+		zap.S().Error(err)
+	}
+	zap.S().Info("shutdown finished")
 }
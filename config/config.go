@@ -39,23 +39,85 @@ func (c certificate) MarshalJSON() ([]byte, error) {
 }
 
 type Config struct {
-	LogLevel    string `default:"debug" env:"LOG_LEVEL"`
-	DryRun      bool   `default:"false" env:"DRY_RUN"`
-	InCluster   bool   `default:"true" env:"IN_CLUSTER"`
-	Kubeconfig  string `default:"" env:"KUBECONFIG"`
-	TokenPath   string `default:"/var/run/secrets/kubernetes.io/serviceaccount/token" env:"TOKEN_PATH"`
-	VaultAddr   string `default:"https://vault-active.vault.svc.cluster.local:8200" env:"VAULT_ADDR"`
-	VaultRole   string `default:"vault-secret-syncer" env:"VAULT_ROLE"`
-	SecretLabel string `default:"vault-injector" env:"SECRET_LABEL"`
-	SecretMap   string `default:"map.yaml" env:"SECRET_MAP"`
-	Interval    int    `default:"900" env:"INTERVAL"`
-	Telegram    struct {
-		Channel int64    `default:"1234" env:"TELEGRAM_ALERT_CHANEL"`
-		Token   Password `env:"TELEGRAM_TOKEN"`
+	LogLevel        string `default:"debug" env:"LOG_LEVEL"`
+	DryRun          bool   `default:"false" env:"DRY_RUN"`
+	DryRunServer    bool   `default:"false" env:"DRY_RUN_SERVER"`
+	InCluster       bool   `default:"true" env:"IN_CLUSTER"`
+	Kubeconfig      string `default:"" env:"KUBECONFIG"`
+	TokenPath       string `default:"/var/run/secrets/kubernetes.io/serviceaccount/token" env:"TOKEN_PATH"`
+	VaultAddr       string `default:"https://vault-active.vault.svc.cluster.local:8200" env:"VAULT_ADDR"`
+	VaultRole       string `default:"vault-secret-syncer" env:"VAULT_ROLE"`
+	VaultNamespace  string `default:"" env:"VAULT_NAMESPACE"`
+	VaultKVVersions string `default:"" env:"VAULT_KV_VERSIONS"`
+	SecretLabel     string `default:"vault-injector" env:"SECRET_LABEL"`
+	InstanceName    string `default:"vault-injector" env:"INSTANCE_NAME"`
+	PrunePolicy     string `default:"delete" env:"PRUNE_POLICY"`
+	PruneMaxPercent int    `default:"30" env:"PRUNE_MAX_PERCENT"`
+	PruneMinCount   int    `default:"3" env:"PRUNE_MIN_COUNT"`
+	PruneForce      bool   `default:"false" env:"PRUNE_FORCE"`
+	SecretMap       string `default:"map.yaml" env:"SECRET_MAP"`
+	Interval        int    `default:"900" env:"INTERVAL"`
+	ShutdownTimeout int    `default:"30" env:"SHUTDOWN_TIMEOUT"`
+	LivenessFactor  int    `default:"3" env:"LIVENESS_FACTOR"`
+	Workers         int    `default:"4" env:"WORKERS"`
+	MaxRetries      int    `default:"10" env:"MAX_RETRIES"`
+	PKIRenewPercent int    `default:"66" env:"PKI_RENEW_PERCENT"`
+	VaultAuth       struct {
+		Method       string   `default:"kubernetes" env:"VAULT_AUTH_METHOD"`
+		Mount        string   `default:"" env:"VAULT_AUTH_MOUNT"`
+		RoleID       string   `default:"" env:"VAULT_ROLE_ID"`
+		SecretID     Password `env:"VAULT_SECRET_ID"`
+		SecretIDFile string   `default:"" env:"VAULT_SECRET_ID_FILE"`
+		Token        Password `env:"VAULT_TOKEN"`
+		TokenFile    string   `default:"" env:"VAULT_TOKEN_FILE"`
+		JWT          Password `env:"VAULT_JWT"`
+		JWTFile      string   `default:"" env:"VAULT_JWT_FILE"`
+		Username     string   `default:"" env:"VAULT_USERNAME"`
+		Password     Password `env:"VAULT_PASSWORD"`
+		PasswordFile string   `default:"" env:"VAULT_PASSWORD_FILE"`
+		RevokeToken  bool     `default:"false" env:"VAULT_REVOKE_TOKEN"`
+	}
+	LeaderElection struct {
+		Enabled   bool   `default:"false" env:"LEADER_ELECTION"`
+		Namespace string `default:"default" env:"POD_NAMESPACE"`
+		Name      string `default:"vault-injector" env:"LEADER_ELECTION_NAME"`
+		Identity  string `default:"" env:"POD_NAME"`
+	}
+	Telegram struct {
+		Channel  int64    `default:"1234" env:"TELEGRAM_ALERT_CHANEL"`
+		Token    Password `env:"TELEGRAM_TOKEN"`
+		URL      string   `default:"https://api.telegram.org" env:"TELEGRAM_URL"`
+		Severity string   `default:"info" env:"TELEGRAM_SEVERITY"`
+		Template string   `default:"" env:"TELEGRAM_TEMPLATE"`
+	}
+	Notify struct {
+		Dedup    int    `default:"600" env:"NOTIFY_DEDUP"`
+		Template string `default:"" env:"NOTIFY_TEMPLATE"`
+	}
+	Slack struct {
+		WebhookURL Password `env:"SLACK_WEBHOOK_URL"`
+		Severity   string   `default:"warning" env:"SLACK_SEVERITY"`
+		Template   string   `default:"" env:"SLACK_TEMPLATE"`
+	}
+	Webhook struct {
+		URL      string   `default:"" env:"WEBHOOK_URL"`
+		Token    Password `env:"WEBHOOK_TOKEN"`
+		Severity string   `default:"warning" env:"WEBHOOK_SEVERITY"`
+		Template string   `default:"" env:"WEBHOOK_TEMPLATE"`
+	}
+	SMTP struct {
+		Addr     string   `default:"" env:"SMTP_ADDR"`
+		From     string   `default:"vault-injector@localhost" env:"SMTP_FROM"`
+		To       string   `default:"" env:"SMTP_TO"`
+		Username string   `default:"" env:"SMTP_USERNAME"`
+		Password Password `env:"SMTP_PASSWORD"`
+		Severity string   `default:"error" env:"SMTP_SEVERITY"`
+		Template string   `default:"" env:"SMTP_TEMPLATE"`
 	}
 	HTTP struct {
-		ADDR        string `default:":8080" env:"HTTP_ADDR"`
-		RoutePrefix string `default:"" env:"HTTP_ROUTE_PREFIX"`
+		ADDR        string   `default:":8080" env:"HTTP_ADDR"`
+		RoutePrefix string   `default:"" env:"HTTP_ROUTE_PREFIX"`
+		AdminToken  Password `env:"HTTP_ADMIN_TOKEN"`
 	}
 }
 
@@ -5,8 +5,11 @@ import (
 	"go.uber.org/dig"
 )
 
+// Controller feeds secret keys into the work queue until ctx is done.
 type Controller interface {
-	Start(ctx context.Context)
+	Start(ctx context.Context, queue Queue)
+	// Wait blocks until the controller stopped after ctx is done.
+	Wait()
 }
 
 type Result struct {
@@ -2,17 +2,30 @@ package controller
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"go.uber.org/dig"
 	"go.uber.org/zap"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"vault-injector/config"
 	"vault-injector/internal/k8s"
+	"vault-injector/pkg/health"
+	"vault-injector/pkg/metrics"
 	"vault-injector/pkg/vault"
 )
 
 type loopController struct {
-	p loopControllerParams
+	p     loopControllerParams
+	queue Queue
+	// lastDone is the unix time of the last pass synced without errors, zero
+	// until the first one. lastPass is the last pass the queue drained,
+	// failed keys included.
+	lastDone atomic.Int64
+	lastPass atomic.Int64
+	started  atomic.Int64
+	done     sync.WaitGroup
 }
 
 type loopControllerParams struct {
@@ -22,14 +35,17 @@ type loopControllerParams struct {
 	Kr          k8s.KubeRepo
 	Vault       vault.Service
 	ForceUpdate chan config.UpdateInterface
+	Health      *health.Registry
 }
 
 type LoopController interface {
 	UpdateSecretList(ctx context.Context)
 	CreateSecretList(ctx context.Context)
-	Start(ctx context.Context)
+	Start(ctx context.Context, queue Queue)
 }
 
+// UpdateSecretList queues every managed secret and prunes the ones gone from
+// the map.
 func (c *loopController) UpdateSecretList(ctx context.Context) {
 	zap.S().Infof("UpdateSecretList start")
 	defer func() {
@@ -41,10 +57,14 @@ func (c *loopController) UpdateSecretList(ctx context.Context) {
 
 	secretList := c.p.Kr.GetSecretList(ctx)
 	for _, secret := range secretList.Items {
-		c.p.Kr.CompareSecret(ctx, &secret)
+		c.queue.Add(ctx, secret.Namespace+"/"+secret.Name)
 	}
+	c.p.Kr.PruneSecrets(ctx, secretList.Items)
 }
 
+// CreateSecretList queues the secrets from the map which don't exist yet. It
+// runs on every pass, the first one included, so it counts the managed
+// secrets and forgets the status of the ones gone from the map.
 func (c *loopController) CreateSecretList(ctx context.Context) {
 	zap.S().Infof("CreateSecretList start")
 	defer func() {
@@ -54,28 +74,90 @@ func (c *loopController) CreateSecretList(ctx context.Context) {
 		zap.S().Infof("%s CreateSecretList finish", time.Now())
 	}()
 	secretList := c.p.Kr.GetSecretList(ctx)
+	metrics.ManagedSecrets.Set(float64(len(secretList.Items)))
 	secretMap := c.p.Vault.GetSecretMap()
+	c.queue.PruneStatus(secretMap)
 	for _, secret := range secretList.Items {
 		if _, ok := secretMap[secret.Namespace+"/"+secret.Name]; ok {
 			delete(secretMap, secret.Namespace+"/"+secret.Name)
 		}
 	}
-	for _, newSecret := range secretMap {
-		if strings.Contains(newSecret.Name, "dockerconfigjson") {
-			zap.S().Infof("%s(%s) create docker secret", newSecret.Name, newSecret.Namespace)
-			c.p.Kr.CreateDockerSecret(ctx, newSecret.Namespace, newSecret.Name)
-		} else {
-			zap.S().Infof("%s(%s) create empty secret", newSecret.Name, newSecret.Namespace)
-			c.p.Kr.CreateEmptySecret(ctx, newSecret.Namespace, newSecret.Name)
-		}
+	for key := range secretMap {
+		c.queue.Add(ctx, key)
+	}
+}
+
+// reconcile queues one full pass. Keys of a pass share a single vault read
+// cache, so every mount/path is fetched from vault once per pass. The cache
+// is dropped once the pass is synced.
+func (c *loopController) reconcile(ctx context.Context, update bool) *pass {
+	p := newPass()
+	passCtx := withPass(vault.WithReadCache(ctx), p)
+	if update {
+		c.UpdateSecretList(passCtx)
+	}
+	c.CreateSecretList(passCtx)
+	p.seal()
+	go c.finishPass(ctx, passCtx, p)
+	return p
+}
+
+// finishPass waits until the queue synced every key of the pass, retries
+// included. Only a pass without failed keys counts as completed.
+func (c *loopController) finishPass(ctx, passCtx context.Context, p *pass) {
+	failed, ok := p.wait(ctx)
+	if !ok {
+		return
+	}
+	vault.LogReadCache(passCtx)
+	c.lastPass.Store(time.Now().Unix())
+	if failed > 0 {
+		zap.S().Warnf("reconcile finished, %d secrets failed", failed)
+		return
+	}
+	metrics.LastReconcile.SetToCurrentTime()
+	if c.lastDone.Swap(time.Now().Unix()) == 0 {
+		zap.S().Info("first reconcile finished")
+		return
 	}
+	zap.S().Info("reconcile finished")
 }
 
-func (c *loopController) Start(ctx context.Context) {
+// checkReady fails until a pass synced every secret without errors.
+func (c *loopController) checkReady() error {
+	if c.lastDone.Load() == 0 {
+		return errors.New("first reconcile not finished")
+	}
+	return nil
+}
+
+// checkLive fails when the queue drained no pass within LivenessFactor
+// intervals since the last one or the start, e.g. after the loop goroutine
+// died. Failed syncs, e.g. while vault is down, don't restart the pod.
+func (c *loopController) checkLive() error {
+	lastPass := c.lastPass.Load()
+	if lastPass == 0 {
+		lastPass = c.started.Load()
+	}
+	maxAge := time.Duration(c.p.Cfg.LivenessFactor*c.p.Cfg.Interval) * time.Second
+	if age := time.Since(time.Unix(lastPass, 0)); age > maxAge {
+		return fmt.Errorf("last reconcile %s ago, limit %s", age.Round(time.Second), maxAge)
+	}
+	return nil
+}
+
+func (c *loopController) Start(ctx context.Context, queue Queue) {
+	c.queue = queue
+	c.started.Store(time.Now().Unix())
+	c.p.Health.Register("reconcile", health.Readiness, c.checkReady)
+	c.p.Health.Register("loop", health.Liveness, c.checkLive)
+	c.done.Add(1)
 	go func() {
+		defer c.done.Done()
 		zap.S().Info("LoopController start")
-		c.CreateSecretList(ctx)
+		c.reconcile(ctx, false)
 		ticker := time.NewTicker(time.Second * time.Duration(c.p.Cfg.Interval))
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ctx.Done():
@@ -83,17 +165,19 @@ func (c *loopController) Start(ctx context.Context) {
 				return
 			case <-c.p.ForceUpdate:
 				zap.S().Info("force update")
-				c.UpdateSecretList(ctx)
-				c.CreateSecretList(ctx)
+				c.reconcile(ctx, true)
 			case <-ticker.C:
 				zap.S().Info("tiker update")
-				c.UpdateSecretList(ctx)
-				c.CreateSecretList(ctx)
+				c.reconcile(ctx, true)
 			}
 		}
 	}()
 }
 
+func (c *loopController) Wait() {
+	c.done.Wait()
+}
+
 func NewLoopController(p loopControllerParams) Result {
 	return Result{
 		Controller: &loopController{
@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"slices"
+	"testing"
+	"time"
+	"vault-injector/config"
+	"vault-injector/pkg/health"
+	"vault-injector/pkg/metrics"
+	"vault-injector/pkg/vault"
+)
+
+type fakeVault struct {
+	vault.Service
+	secretMap vault.SecretMap
+}
+
+func (f *fakeVault) GetSecretMap() vault.SecretMap {
+	return f.secretMap
+}
+
+func (f *fakeVault) GetSecretCfg(namespace, name string) (vault.Secret, bool) {
+	secret, ok := f.secretMap[namespace+"/"+name]
+	return secret, ok
+}
+
+// fakeQueue records the keys added.
+type fakeQueue struct {
+	keys []string
+}
+
+func (f *fakeQueue) Add(ctx context.Context, key string) {
+	f.keys = append(f.keys, key)
+}
+
+func (f *fakeQueue) PruneStatus(secretMap vault.SecretMap) {}
+
+func newTestLoop(kr *fakeRepo, secretMap vault.SecretMap, queue Queue) *loopController {
+	return &loopController{
+		p: loopControllerParams{
+			Cfg:    &config.Config{Interval: 60, LivenessFactor: 3},
+			Kr:     kr,
+			Vault:  &fakeVault{secretMap: secretMap},
+			Health: health.NewRegistry(),
+		},
+		queue: queue,
+	}
+}
+
+func TestCreateSecretList(t *testing.T) {
+	kr := newFakeRepo(nil)
+	kr.secrets = []v1.Secret{{ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "a"}}}
+	queue := &fakeQueue{}
+	c := newTestLoop(kr, vault.SecretMap{"dev/a": {}, "dev/b": {}}, queue)
+	c.CreateSecretList(context.Background())
+	if !slices.Equal(queue.keys, []string{"dev/b"}) {
+		t.Errorf("queued %v, want the missing dev/b", queue.keys)
+	}
+	if got := testutil.ToFloat64(metrics.ManagedSecrets); got != 1 {
+		t.Errorf("managed secrets %v, want 1 after the first pass", got)
+	}
+}
+
+func TestLastReconcileNeedsCleanPass(t *testing.T) {
+	metrics.LastReconcile.Set(0)
+	c := newTestLoop(newFakeRepo(nil), nil, &fakeQueue{})
+	ctx := context.Background()
+
+	p := newPass()
+	p.add("dev/a")
+	p.seal()
+	p.finish("dev/a", false)
+	c.finishPass(ctx, ctx, p)
+	if got := testutil.ToFloat64(metrics.LastReconcile); got != 0 {
+		t.Errorf("failed pass set last reconcile to %v", got)
+	}
+
+	p = newPass()
+	p.seal()
+	c.finishPass(ctx, ctx, p)
+	if got := testutil.ToFloat64(metrics.LastReconcile); got == 0 {
+		t.Error("clean pass did not set last reconcile")
+	}
+}
+
+func TestReadyAfterCleanPass(t *testing.T) {
+	c := newTestLoop(newFakeRepo(nil), nil, &fakeQueue{})
+	ctx := context.Background()
+	if c.checkReady() == nil {
+		t.Fatal("ready before the first pass")
+	}
+
+	p := newPass()
+	p.add("dev/a")
+	p.seal()
+	p.finish("dev/a", false)
+	c.finishPass(ctx, ctx, p)
+	if c.checkReady() == nil {
+		t.Error("ready after a pass with failed secrets")
+	}
+	if c.lastPass.Load() == 0 {
+		t.Error("drained pass not recorded for liveness")
+	}
+
+	p = newPass()
+	p.add("dev/a")
+	p.seal()
+	p.finish("dev/a", true)
+	c.finishPass(ctx, ctx, p)
+	if err := c.checkReady(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckLive(t *testing.T) {
+	c := newTestLoop(newFakeRepo(nil), nil, &fakeQueue{})
+	c.started.Store(time.Now().Unix())
+	if err := c.checkLive(); err != nil {
+		t.Errorf("failed before the first pass: %v", err)
+	}
+	c.started.Store(time.Now().Add(-time.Hour).Unix())
+	if c.checkLive() == nil {
+		t.Error("live without the first pass for an hour")
+	}
+	c.lastPass.Store(time.Now().Unix())
+	if err := c.checkLive(); err != nil {
+		t.Error(err)
+	}
+	c.lastPass.Store(time.Now().Add(-time.Hour).Unix())
+	if c.checkLive() == nil {
+		t.Error("live without a pass for an hour")
+	}
+}
@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"context"
+	"sync"
+)
+
+// pass follows the keys of one loop pass through the queue, retries
+// included, until each of them synced or was dropped after MaxRetries.
+type pass struct {
+	pending map[string]bool
+	failed  int
+	sealed  bool
+	done    chan struct{}
+	sync.Mutex
+}
+
+type passCtxKey struct{}
+
+func newPass() *pass {
+	return &pass{pending: make(map[string]bool), done: make(chan struct{})}
+}
+
+// withPass makes keys added with ctx part of the pass.
+func withPass(ctx context.Context, p *pass) context.Context {
+	return context.WithValue(ctx, passCtxKey{}, p)
+}
+
+func getPass(ctx context.Context) *pass {
+	p, _ := ctx.Value(passCtxKey{}).(*pass)
+	return p
+}
+
+func (p *pass) add(key string) {
+	p.Lock()
+	defer p.Unlock()
+	p.pending[key] = true
+}
+
+// finish records the final outcome of a key.
+func (p *pass) finish(key string, ok bool) {
+	p.Lock()
+	defer p.Unlock()
+	if !p.pending[key] {
+		return
+	}
+	delete(p.pending, key)
+	if !ok {
+		p.failed++
+	}
+	p.closeIfDone()
+}
+
+// seal is called once every key of the pass is added, the pass can't be done
+// before.
+func (p *pass) seal() {
+	p.Lock()
+	defer p.Unlock()
+	p.sealed = true
+	p.closeIfDone()
+}
+
+func (p *pass) closeIfDone() {
+	if p.sealed && len(p.pending) == 0 {
+		select {
+		case <-p.done:
+		default:
+			close(p.done)
+		}
+	}
+}
+
+// wait blocks until the pass is done and returns the number of keys which
+// failed, false when ctx ended first.
+func (p *pass) wait(ctx context.Context) (int, bool) {
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return 0, false
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.failed, true
+}
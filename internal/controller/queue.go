@@ -0,0 +1,301 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/dig"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"vault-injector/config"
+	"vault-injector/internal/k8s"
+	"vault-injector/pkg/metrics"
+	"vault-injector/pkg/vault"
+)
+
+// Queue takes namespace/name keys of secrets to reconcile. Keys already
+// waiting in the queue are merged. ctx carries the vault read cache and the
+// pass of a loop pass, a key added with a ctx without a pass, e.g.
+// context.Background(), syncs on its own with a fresh cache.
+type Queue interface {
+	Add(ctx context.Context, key string)
+	// PruneStatus drops the sync status of the keys no longer in the map.
+	PruneStatus(secretMap vault.SecretMap)
+}
+
+// SyncStatus is the outcome of the last sync of a secret.
+type SyncStatus struct {
+	LastSync time.Time `json:"lastSync"`
+	Error    string    `json:"error,omitempty"`
+	Retries  int       `json:"retries,omitempty"`
+}
+
+type workQueueParams struct {
+	dig.In
+
+	Cfg   *config.Config
+	Kr    k8s.KubeRepo
+	Vault vault.Service
+}
+
+type WorkQueue struct {
+	p     workQueueParams
+	queue workqueue.TypedRateLimitingInterface[string]
+	// ctxs keeps the context a key was added with, so keys from one loop
+	// pass share its vault read cache. Retries start with a fresh cache.
+	ctxs map[string]context.Context
+	// passes are the loop passes waiting for the outcome of a key.
+	passes     map[string][]*pass
+	ctxsLock   sync.Mutex
+	running    atomic.Bool
+	status     map[string]SyncStatus
+	statusLock sync.Mutex
+	// workCtx ends with leadership, so a replica which lost the Lease stops
+	// writing at once. At shutdown the Lease is held until Wait returned, so
+	// syncs in flight finish their writes unless Wait runs out of time.
+	workCtx    context.Context
+	cancelWork context.CancelFunc
+	stopping   atomic.Bool
+	workers    sync.WaitGroup
+}
+
+func NewWorkQueue(p workQueueParams) *WorkQueue {
+	if p.Cfg.Workers < 1 {
+		zap.S().Fatalf("WORKERS must be at least 1, got %d", p.Cfg.Workers)
+	}
+	rateLimiter := workqueue.NewTypedItemExponentialFailureRateLimiter[string](time.Second, 5*time.Minute)
+	return &WorkQueue{
+		p: p,
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(rateLimiter,
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "secrets"}),
+		ctxs:   make(map[string]context.Context),
+		passes: make(map[string][]*pass),
+		status: make(map[string]SyncStatus),
+	}
+}
+
+func (q *WorkQueue) Add(ctx context.Context, key string) {
+	q.ctxsLock.Lock()
+	p := getPass(ctx)
+	if p == nil {
+		// keep the context of a pass the key already waits with
+		if _, queued := q.ctxs[key]; !queued {
+			q.ctxs[key] = ctx
+		}
+	} else {
+		q.ctxs[key] = ctx
+		if !slices.Contains(q.passes[key], p) {
+			p.add(key)
+			q.passes[key] = append(q.passes[key], p)
+		}
+	}
+	q.ctxsLock.Unlock()
+	q.queue.Add(key)
+	metrics.QueueDepth.Set(float64(q.queue.Len()))
+}
+
+// Running reports whether the workers run, i.e. this replica is the leader.
+func (q *WorkQueue) Running() bool {
+	return q.running.Load()
+}
+
+// Status returns the last sync outcome of a secret.
+func (q *WorkQueue) Status(key string) (SyncStatus, bool) {
+	q.statusLock.Lock()
+	defer q.statusLock.Unlock()
+	status, ok := q.status[key]
+	return status, ok
+}
+
+func (q *WorkQueue) PruneStatus(secretMap vault.SecretMap) {
+	q.statusLock.Lock()
+	defer q.statusLock.Unlock()
+	for key := range q.status {
+		if _, ok := secretMap[key]; !ok {
+			delete(q.status, key)
+		}
+	}
+}
+
+func (q *WorkQueue) setStatus(key string, err error) {
+	status := SyncStatus{LastSync: time.Now(), Retries: q.queue.NumRequeues(key)}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	q.statusLock.Lock()
+	q.status[key] = status
+	q.statusLock.Unlock()
+}
+
+// Start runs the workers until ctx is done. Keys still waiting then are
+// dropped, keys in flight are finished, see Wait. Syncs are cancelled as soon
+// as leaderCtx is done.
+func (q *WorkQueue) Start(ctx, leaderCtx context.Context) {
+	q.workCtx, q.cancelWork = context.WithCancel(leaderCtx)
+	q.running.Store(true)
+	zap.S().Infof("WorkQueue start with %d workers", q.p.Cfg.Workers)
+	for i := 0; i < q.p.Cfg.Workers; i++ {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			for q.next() {
+			}
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		q.running.Store(false)
+		q.stopping.Store(true)
+		q.queue.ShutDown()
+	}()
+}
+
+// Wait blocks until the workers finished the syncs in flight. After timeout
+// the syncs are cancelled.
+func (q *WorkQueue) Wait(timeout time.Duration) {
+	if q.cancelWork == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		zap.S().Info("WorkQueue drained")
+	case <-time.After(timeout):
+		zap.S().Warnf("WorkQueue not drained after %s, cancel syncs in flight", timeout)
+		q.cancelWork()
+		<-done
+	}
+	q.cancelWork()
+}
+
+func (q *WorkQueue) next() bool {
+	key, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(key)
+	if q.stopping.Load() {
+		zap.S().Debugf("%s shutting down - SKIP", key)
+		return true
+	}
+
+	q.ctxsLock.Lock()
+	addCtx, ok := q.ctxs[key]
+	delete(q.ctxs, key)
+	q.ctxsLock.Unlock()
+	itemCtx := addCtx
+	if !ok || itemCtx.Err() != nil {
+		itemCtx = vault.WithReadCache(q.workCtx)
+	} else {
+		// keep the read cache of the pass, but only stop with workCtx
+		var cancel context.CancelFunc
+		itemCtx, cancel = context.WithCancel(vault.EnsureReadCache(context.WithoutCancel(itemCtx)))
+		defer cancel()
+		defer context.AfterFunc(q.workCtx, cancel)()
+	}
+
+	start := time.Now()
+	err := q.sync(itemCtx, key)
+	metrics.SyncDuration.Observe(time.Since(start).Seconds())
+	if errors.Is(err, errFillPending) && q.queue.NumRequeues(key) < q.p.Cfg.MaxRetries {
+		// the secret is synced once it is filled, keep it in its pass
+		zap.S().Debugf("%s %v", key, err)
+		if ok {
+			q.ctxsLock.Lock()
+			if _, newer := q.ctxs[key]; !newer {
+				q.ctxs[key] = addCtx
+			}
+			q.ctxsLock.Unlock()
+		}
+		q.queue.AddRateLimited(key)
+		return true
+	}
+	q.setStatus(key, err)
+	switch {
+	case err == nil:
+		metrics.Syncs.WithLabelValues("success").Inc()
+		metrics.LastSyncSuccess.SetToCurrentTime()
+		q.queue.Forget(key)
+		q.finishPasses(key, true)
+	case q.queue.NumRequeues(key) < q.p.Cfg.MaxRetries:
+		metrics.Syncs.WithLabelValues("error").Inc()
+		zap.S().Warnf("%s sync failed, retry %d: %v", key, q.queue.NumRequeues(key)+1, err)
+		q.queue.AddRateLimited(key)
+	default:
+		metrics.Syncs.WithLabelValues("dropped").Inc()
+		zap.S().Errorf("%s sync failed after %d retries, wait for next update: %v", key, q.p.Cfg.MaxRetries, err)
+		q.queue.Forget(key)
+		q.finishPasses(key, false)
+	}
+	metrics.QueueDepth.Set(float64(q.queue.Len()))
+	return true
+}
+
+// finishPasses hands the final outcome of a key to the passes waiting for it.
+// A key waiting for a retry is not final yet.
+func (q *WorkQueue) finishPasses(key string, ok bool) {
+	q.ctxsLock.Lock()
+	passes := q.passes[key]
+	delete(q.passes, key)
+	q.ctxsLock.Unlock()
+	for _, p := range passes {
+		p.finish(key, ok)
+	}
+}
+
+// errFillPending is returned for a secret which exists but was not synced
+// yet, the informer has to see it first.
+var errFillPending = errors.New("created, fill waits for the informer")
+
+// sync updates the secret when it exists and creates it when it is in the
+// map. An empty secret created here is filled from vault by a later sync.
+func (q *WorkQueue) sync(ctx context.Context, key string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			zap.S().Error(r)
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		zap.S().Errorf("wrong key %q: %v", key, err)
+		return nil
+	}
+	secret, err := q.p.Kr.GetSecret(ctx, namespace, name)
+	if err != nil {
+		return err
+	}
+	if secret != nil {
+		return q.p.Kr.CompareSecret(ctx, secret)
+	}
+	secretCfg, ok := q.p.Vault.GetSecretCfg(namespace, name)
+	if !ok {
+		return nil
+	}
+	if secretCfg.Type == v1.SecretTypeOpaque && !secretCfg.Immutable {
+		zap.S().Infof("%s(%s) create empty secret", name, namespace)
+		err = q.p.Kr.CreateEmptySecret(ctx, namespace, name)
+		if err == nil && !q.p.Cfg.DryRun {
+			return errFillPending
+		}
+	} else {
+		zap.S().Infof("%s(%s) create %s secret", name, namespace, secretCfg.Type)
+		err = q.p.Kr.CreateSecret(ctx, namespace, name)
+	}
+	if apierrors.IsAlreadyExists(err) {
+		// the informer has not seen it yet
+		return errFillPending
+	}
+	return err
+}
@@ -0,0 +1,296 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+	"sync"
+	"testing"
+	"time"
+	"vault-injector/config"
+	"vault-injector/internal/k8s"
+	"vault-injector/pkg/vault"
+)
+
+// fakeRepo fails the sync of a key as often as fails says. Keys in missing
+// don't exist until they are created.
+type fakeRepo struct {
+	k8s.KubeRepo
+	fails   map[string]int
+	calls   map[string]int
+	missing map[string]bool
+	created []string
+	secrets []v1.Secret
+	sync.Mutex
+}
+
+func newFakeRepo(fails map[string]int) *fakeRepo {
+	return &fakeRepo{fails: fails, calls: make(map[string]int)}
+}
+
+func (f *fakeRepo) GetSecret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.missing[namespace+"/"+name] {
+		return nil, nil
+	}
+	return &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}, nil
+}
+
+func (f *fakeRepo) CreateEmptySecret(ctx context.Context, namespace, name string) error {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.missing, namespace+"/"+name)
+	f.created = append(f.created, namespace+"/"+name)
+	return nil
+}
+
+func (f *fakeRepo) CompareSecret(ctx context.Context, secret *v1.Secret) error {
+	f.Lock()
+	defer f.Unlock()
+	key := secret.Namespace + "/" + secret.Name
+	f.calls[key]++
+	if f.calls[key] <= f.fails[key] {
+		return errors.New("vault read failed")
+	}
+	return nil
+}
+
+func (f *fakeRepo) GetSecretList(ctx context.Context) *v1.SecretList {
+	return &v1.SecretList{Items: f.secrets}
+}
+
+func (f *fakeRepo) PruneSecrets(ctx context.Context, secrets []v1.Secret) {}
+
+func (f *fakeRepo) callsOf(key string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.calls[key]
+}
+
+func newTestQueue(t *testing.T, kr k8s.KubeRepo, maxRetries int, backoff time.Duration) *WorkQueue {
+	t.Helper()
+	q := NewWorkQueue(workQueueParams{Cfg: &config.Config{Workers: 2, MaxRetries: maxRetries}, Kr: kr})
+	q.queue = workqueue.NewTypedRateLimitingQueue(workqueue.NewTypedItemExponentialFailureRateLimiter[string](backoff, backoff))
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Start(ctx, ctx)
+	t.Cleanup(func() {
+		cancel()
+		q.Wait(time.Second)
+	})
+	return q
+}
+
+func waitPass(t *testing.T, p *pass) int {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	failed, ok := p.wait(ctx)
+	if !ok {
+		t.Fatal("pass not finished")
+	}
+	return failed
+}
+
+func TestQueueRetries(t *testing.T) {
+	kr := newFakeRepo(map[string]int{"dev/a": 2})
+	q := newTestQueue(t, kr, 5, time.Millisecond)
+	p := newPass()
+	q.Add(withPass(context.Background(), p), "dev/a")
+	p.seal()
+	if failed := waitPass(t, p); failed != 0 {
+		t.Errorf("%d keys failed, want none", failed)
+	}
+	if calls := kr.callsOf("dev/a"); calls != 3 {
+		t.Errorf("%d syncs, want 3", calls)
+	}
+	status, ok := q.Status("dev/a")
+	if !ok || status.Error != "" || status.Retries != 2 {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestQueueDropsAfterMaxRetries(t *testing.T) {
+	kr := newFakeRepo(map[string]int{"dev/a": 100})
+	q := newTestQueue(t, kr, 2, time.Millisecond)
+	p := newPass()
+	q.Add(withPass(context.Background(), p), "dev/a")
+	q.Add(withPass(context.Background(), p), "dev/b")
+	p.seal()
+	if failed := waitPass(t, p); failed != 1 {
+		t.Errorf("%d keys failed, want 1", failed)
+	}
+	if calls := kr.callsOf("dev/a"); calls != 3 {
+		t.Errorf("%d syncs, want 3", calls)
+	}
+	if status, _ := q.Status("dev/a"); status.Error == "" {
+		t.Error("status has no error")
+	}
+}
+
+func TestPassWaitsForRetries(t *testing.T) {
+	kr := newFakeRepo(map[string]int{"dev/a": 1})
+	q := newTestQueue(t, kr, 5, 300*time.Millisecond)
+	p := newPass()
+	q.Add(withPass(context.Background(), p), "dev/a")
+	q.Add(withPass(context.Background(), p), "dev/b")
+	p.seal()
+	for kr.callsOf("dev/a") == 0 || kr.callsOf("dev/b") == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// dev/a waits for its retry, out of the queue but not synced
+	if q.queue.Len() != 0 {
+		t.Fatalf("queue length %d, want the retry to wait outside", q.queue.Len())
+	}
+	select {
+	case <-p.done:
+		t.Fatal("pass done while a key waits for its retry")
+	default:
+	}
+	if failed := waitPass(t, p); failed != 0 {
+		t.Errorf("%d keys failed, want none", failed)
+	}
+}
+
+func TestPassEmpty(t *testing.T) {
+	p := newPass()
+	select {
+	case <-p.done:
+		t.Fatal("pass done before it was sealed")
+	default:
+	}
+	p.seal()
+	if failed := waitPass(t, p); failed != 0 {
+		t.Errorf("%d keys failed", failed)
+	}
+}
+
+func TestPruneStatus(t *testing.T) {
+	kr := newFakeRepo(nil)
+	q := newTestQueue(t, kr, 1, time.Millisecond)
+	p := newPass()
+	q.Add(withPass(context.Background(), p), "dev/a")
+	q.Add(withPass(context.Background(), p), "dev/b")
+	p.seal()
+	waitPass(t, p)
+	q.PruneStatus(vault.SecretMap{"dev/a": {}})
+	if _, ok := q.Status("dev/a"); !ok {
+		t.Error("status of dev/a dropped")
+	}
+	if _, ok := q.Status("dev/b"); ok {
+		t.Error("status of dev/b kept after it left the map")
+	}
+}
+
+// blockingRepo holds every sync until release is closed or its context ends.
+type blockingRepo struct {
+	k8s.KubeRepo
+	started chan struct{}
+	release chan struct{}
+	err     chan error
+}
+
+func newBlockingRepo() *blockingRepo {
+	return &blockingRepo{started: make(chan struct{}, 1), release: make(chan struct{}), err: make(chan error, 1)}
+}
+
+func (b *blockingRepo) GetSecret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	return &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}, nil
+}
+
+func (b *blockingRepo) CompareSecret(ctx context.Context, secret *v1.Secret) error {
+	b.started <- struct{}{}
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+	}
+	b.err <- ctx.Err()
+	return ctx.Err()
+}
+
+func startBlocked(t *testing.T, kr *blockingRepo) (*WorkQueue, context.CancelFunc, context.CancelFunc) {
+	t.Helper()
+	q := NewWorkQueue(workQueueParams{Cfg: &config.Config{Workers: 1, MaxRetries: 1}, Kr: kr})
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(leaderCtx)
+	q.Start(ctx, leaderCtx)
+	q.Add(context.Background(), "dev/a")
+	select {
+	case <-kr.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sync not started")
+	}
+	return q, cancel, cancelLeader
+}
+
+func TestShutdownFinishesSyncs(t *testing.T) {
+	kr := newBlockingRepo()
+	q, cancel, cancelLeader := startBlocked(t, kr)
+	defer cancelLeader()
+	cancel()
+	time.AfterFunc(100*time.Millisecond, func() { close(kr.release) })
+	q.Wait(5 * time.Second)
+	if err := <-kr.err; err != nil {
+		t.Errorf("sync in flight cancelled at shutdown: %v", err)
+	}
+}
+
+func TestLeadershipLossCancelsSyncs(t *testing.T) {
+	kr := newBlockingRepo()
+	q, cancel, cancelLeader := startBlocked(t, kr)
+	defer cancel()
+	cancelLeader()
+	select {
+	case err := <-kr.err:
+		if err == nil {
+			t.Error("sync finished without its context cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sync still writes after leadership was lost")
+	}
+	q.Wait(time.Second)
+}
+
+func TestPassWaitsForFill(t *testing.T) {
+	kr := newFakeRepo(map[string]int{"dev/a": 100})
+	kr.missing = map[string]bool{"dev/a": true}
+	q := NewWorkQueue(workQueueParams{
+		Cfg:   &config.Config{Workers: 1, MaxRetries: 2},
+		Kr:    kr,
+		Vault: &fakeVault{secretMap: vault.SecretMap{"dev/a": {Namespace: "dev", Name: "a", Type: v1.SecretTypeOpaque}}},
+	})
+	q.queue = workqueue.NewTypedRateLimitingQueue(workqueue.NewTypedItemExponentialFailureRateLimiter[string](time.Millisecond, time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.Start(ctx, ctx)
+	p := newPass()
+	q.Add(withPass(context.Background(), p), "dev/a")
+	p.seal()
+	// created empty, then every vault read fails
+	if failed := waitPass(t, p); failed != 1 {
+		t.Errorf("%d keys failed, want the unfilled secret", failed)
+	}
+	if len(kr.created) != 1 || kr.callsOf("dev/a") == 0 {
+		t.Errorf("created %v, %d fills", kr.created, kr.callsOf("dev/a"))
+	}
+}
+
+func TestAddWithoutPassKeepsQueuedPass(t *testing.T) {
+	q := NewWorkQueue(workQueueParams{Cfg: &config.Config{Workers: 1}, Kr: newFakeRepo(nil)})
+	p := newPass()
+	passCtx := withPass(context.Background(), p)
+	q.Add(passCtx, "dev/a")
+	q.Add(context.Background(), "dev/a")
+	q.Add(context.Background(), "dev/b")
+	if q.ctxs["dev/a"] != passCtx || len(q.passes["dev/a"]) != 1 {
+		t.Error("dev/a left its pass")
+	}
+	if getPass(q.ctxs["dev/b"]) != nil || len(q.passes["dev/b"]) != 0 {
+		t.Error("dev/b joined a pass")
+	}
+	if q.queue.Len() != 2 {
+		t.Errorf("%d keys queued, want 2", q.queue.Len())
+	}
+}
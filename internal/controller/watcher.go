@@ -5,12 +5,12 @@ import (
 	"go.uber.org/dig"
 	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
 	"reflect"
-	"sync"
-	"time"
 	"vault-injector/config"
 	"vault-injector/internal/k8s"
+	"vault-injector/pkg/metrics"
+	"vault-injector/pkg/vault"
 )
 
 type watchControllerParams struct {
@@ -21,57 +21,47 @@ type watchControllerParams struct {
 }
 
 type watchController struct {
-	p watchControllerParams
+	p     watchControllerParams
+	ctx   context.Context
+	queue Queue
 }
 
-func (w *watchController) Watch(ctx context.Context) {
-	watcher := w.p.Kr.WatchSecretList(ctx)
-	if watcher == nil {
+func (w *watchController) onEvent(obj interface{}) {
+	secret, ok := obj.(*v1.Secret)
+	if !ok {
+		zap.S().Errorf("unexpected type %s, %+v", reflect.TypeOf(obj), obj)
 		return
 	}
-	zap.S().Info("WatchController start")
-	defer watcher.Stop()
-	for {
-		select {
-		case event, ok := <-watcher.ResultChan():
-			if !ok {
-				//the channel got closed, so we need to restart
-				zap.S().Warnf("WatchController hung up on us, need restart event watcher")
-				return
-			}
-			if event.Type == watch.Added || event.Type == watch.Modified {
-				secret, ok := event.Object.(*v1.Secret)
-				if !ok {
-					zap.S().Errorf("unexpected type %s, %+v", reflect.TypeOf(event.Object), event)
-				} else {
-					zap.S().Infof("%s(%s) added or modified", secret.Name, secret.Namespace)
-					w.p.Kr.CompareSecret(ctx, secret)
-				}
-			}
-		case <-ctx.Done():
-			zap.S().Infof("Exit from Watcher because the context is done")
-			return
-		}
+	if w.p.Kr.IsOwnWrite(secret) {
+		metrics.WatchEvents.WithLabelValues("own_write").Inc()
+		zap.S().Debugf("%s(%s) own write - SKIP", secret.Name, secret.Namespace)
+		return
 	}
+	zap.S().Infof("%s(%s) added or modified", secret.Name, secret.Namespace)
+	w.queue.Add(vault.WithReadCache(w.ctx), secret.Namespace+"/"+secret.Name)
 }
 
-func (w *watchController) Start(ctx context.Context) {
-	go func() {
-		var wg sync.WaitGroup
-		for {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				if ctx.Err() == nil {
-					w.Watch(ctx)
-				}
-			}()
-			wg.Wait()
-			time.Sleep(1 * time.Second)
-		}
-	}()
+// Start subscribes to the shared secret informer. Reconnects and relists
+// are done by the informer itself.
+func (w *watchController) Start(ctx context.Context, queue Queue) {
+	w.ctx = ctx
+	w.queue = queue
+	zap.S().Info("WatchController start")
+	w.p.Kr.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			metrics.WatchEvents.WithLabelValues("add").Inc()
+			w.onEvent(obj)
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			metrics.WatchEvents.WithLabelValues("update").Inc()
+			w.onEvent(newObj)
+		},
+	})
 }
 
+// Wait returns at once, the handler stops with the informer.
+func (w *watchController) Wait() {}
+
 func NewWatchController(p watchControllerParams) Result {
 	return Result{
 		Controller: &watchController{
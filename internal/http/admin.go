@@ -0,0 +1,181 @@
+package http
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"net/http"
+	"slices"
+	"time"
+	"vault-injector/config"
+	"vault-injector/internal/controller"
+	"vault-injector/internal/k8s"
+	"vault-injector/pkg/vault"
+)
+
+// adminAPI inspects and triggers syncs. Only the leader runs the informer
+// and the queue, so other replicas answer 503 to every call but the index.
+type adminAPI struct {
+	cfg         *config.Config
+	vault       vault.Service
+	kr          k8s.KubeRepo
+	queue       adminQueue
+	forceUpdate chan config.UpdateInterface
+}
+
+// adminQueue is the part of the controller.WorkQueue the admin API uses.
+type adminQueue interface {
+	controller.Queue
+	Running() bool
+	Status(key string) (controller.SyncStatus, bool)
+}
+
+type secretInfo struct {
+	Namespace      string            `json:"namespace"`
+	Name           string            `json:"name"`
+	Type           string            `json:"type"`
+	Paths          []string          `json:"paths,omitempty"`
+	Status         string            `json:"status"`
+	LastSync       *time.Time        `json:"lastSync,omitempty"`
+	Error          string            `json:"error,omitempty"`
+	SourceVersions map[string]int    `json:"sourceVersions,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+}
+
+func (a *adminAPI) routes(r *mux.Router) {
+	r.HandleFunc("/", a.index).Methods(http.MethodGet)
+	r.HandleFunc("/secrets", a.secrets).Methods(http.MethodGet)
+	r.HandleFunc("/secrets/{namespace}/{name}/sync", a.syncSecret).Methods(http.MethodPost)
+	r.HandleFunc("/resync", a.resync).Methods(http.MethodPost)
+	r.HandleFunc("/reload", a.reload).Methods(http.MethodPost)
+}
+
+func (a *adminAPI) index(w http.ResponseWriter, _ *http.Request) {
+	prefix := a.cfg.HTTP.RoutePrefix + "/admin"
+	writeJSON(w, http.StatusOK, map[string]string{
+		"GET " + prefix + "/secrets":                          "managed secrets with their sync status",
+		"POST " + prefix + "/secrets/{namespace}/{name}/sync": "sync one secret",
+		"POST " + prefix + "/resync":                          "full resync",
+		"POST " + prefix + "/reload":                          "reload the secret map",
+	})
+}
+
+// secrets lists every secret of the map and every labelled secret which is
+// no longer in it. Values are never returned.
+func (a *adminAPI) secrets(w http.ResponseWriter, r *http.Request) {
+	if !a.leader(w) {
+		return
+	}
+	existing := make(map[string]bool)
+	var infos []secretInfo
+	if secretList := a.kr.GetSecretList(r.Context()); secretList != nil {
+		secretMap := a.vault.GetSecretMap()
+		for _, secret := range secretList.Items {
+			key := secret.Namespace + "/" + secret.Name
+			existing[key] = true
+			if _, ok := secretMap[key]; ok {
+				continue
+			}
+			infos = append(infos, secretInfo{
+				Namespace: secret.Namespace,
+				Name:      secret.Name,
+				Type:      string(secret.Type),
+				Status:    "not in map",
+			})
+		}
+	}
+	for key, secretCfg := range a.vault.GetSecretMap() {
+		info := secretInfo{
+			Namespace: secretCfg.Namespace,
+			Name:      secretCfg.Name,
+			Type:      string(secretCfg.Type),
+			Paths:     secretCfg.Paths(),
+			Labels:    secretCfg.Labels,
+			Status:    "pending",
+		}
+		if secretCfg.PKI != nil {
+			info.Paths = append(info.Paths, secretCfg.PKI.Issue)
+		}
+		if secret, _ := a.kr.GetSecret(r.Context(), secretCfg.Namespace, secretCfg.Name); secret != nil { //nolint:errcheck
+			json.Unmarshal([]byte(secret.Annotations[a.cfg.SecretLabel+"/source-versions"]), &info.SourceVersions) //nolint:errcheck
+		} else {
+			info.Status = "missing"
+		}
+		if status, ok := a.queue.Status(key); ok {
+			info.LastSync = &status.LastSync
+			info.Status = "synced"
+			if status.Error != "" {
+				info.Status = "error"
+				info.Error = status.Error
+			}
+		}
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b secretInfo) int {
+		if a.Namespace != b.Namespace {
+			return cmp.Compare(a.Namespace, b.Namespace)
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (a *adminAPI) syncSecret(w http.ResponseWriter, r *http.Request) {
+	if !a.leader(w) {
+		return
+	}
+	vars := mux.Vars(r)
+	key := vars["namespace"] + "/" + vars["name"]
+	_, inMap := a.vault.GetSecretCfg(vars["namespace"], vars["name"])
+	secret, _ := a.kr.GetSecret(r.Context(), vars["namespace"], vars["name"]) //nolint:errcheck
+	if !inMap && secret == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": key + " is neither in the map nor managed"})
+		return
+	}
+	zap.S().Infof("admin: sync %s", key)
+	a.queue.Add(context.Background(), key)
+	writeJSON(w, http.StatusAccepted, map[string]string{"queued": key})
+}
+
+func (a *adminAPI) resync(w http.ResponseWriter, _ *http.Request) {
+	if !a.leader(w) {
+		return
+	}
+	zap.S().Info("admin: full resync")
+	select {
+	case a.forceUpdate <- config.UpdateInterface(true):
+	default:
+		// a resync is pending already
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "resync started"})
+}
+
+func (a *adminAPI) reload(w http.ResponseWriter, _ *http.Request) {
+	if !a.leader(w) {
+		return
+	}
+	zap.S().Info("admin: reload secret map")
+	if err := a.vault.ReloadMap(); err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "secret map reloaded"})
+}
+
+func (a *adminAPI) leader(w http.ResponseWriter) bool {
+	if a.queue.Running() {
+		return true
+	}
+	writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "not the leader"})
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		zap.S().Errorf("write response: %v", err)
+	}
+}
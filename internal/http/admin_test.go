@@ -0,0 +1,204 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"vault-injector/config"
+	"vault-injector/internal/controller"
+	"vault-injector/internal/k8s"
+	"vault-injector/pkg/vault"
+)
+
+// fakeQueue is a leader's queue which records the keys added.
+type fakeQueue struct {
+	controller.Queue
+	added  []string
+	status map[string]controller.SyncStatus
+}
+
+func (f *fakeQueue) Add(ctx context.Context, key string) {
+	f.added = append(f.added, key)
+}
+
+func (f *fakeQueue) Running() bool {
+	return true
+}
+
+func (f *fakeQueue) Status(key string) (controller.SyncStatus, bool) {
+	status, ok := f.status[key]
+	return status, ok
+}
+
+// fakeRepo holds the secrets in the cluster.
+type fakeRepo struct {
+	k8s.KubeRepo
+	secrets []v1.Secret
+}
+
+func (f *fakeRepo) GetSecret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	for i := range f.secrets {
+		if f.secrets[i].Namespace == namespace && f.secrets[i].Name == name {
+			return &f.secrets[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeRepo) GetSecretList(ctx context.Context) *v1.SecretList {
+	return &v1.SecretList{Items: f.secrets}
+}
+
+type fakeVault struct {
+	vault.Service
+	secretMap vault.SecretMap
+	reloadErr error
+}
+
+func (f *fakeVault) GetSecretMap() vault.SecretMap {
+	return f.secretMap
+}
+
+func (f *fakeVault) GetSecretCfg(namespace, name string) (vault.Secret, bool) {
+	secret, ok := f.secretMap[namespace+"/"+name]
+	return secret, ok
+}
+
+func (f *fakeVault) ReloadMap() error {
+	return f.reloadErr
+}
+
+func newTestAdmin() (*adminAPI, *fakeQueue, *fakeVault) {
+	queue := &fakeQueue{status: make(map[string]controller.SyncStatus)}
+	fv := &fakeVault{secretMap: vault.SecretMap{
+		"dev/app": {Namespace: "dev", Name: "app", Type: v1.SecretTypeOpaque, ValuePath: []string{"password:projects/dev/db:password"}},
+		"dev/new": {Namespace: "dev", Name: "new", Type: v1.SecretTypeOpaque, ValuePath: []string{"token:projects/dev/api:token"}},
+	}}
+	kr := &fakeRepo{secrets: []v1.Secret{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "app", Annotations: map[string]string{"vault-injector/source-versions": `{"projects/dev/db":3}`}},
+			Data:       map[string][]byte{"password": []byte("s3cret")},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "old"},
+			Type:       v1.SecretTypeOpaque,
+			Data:       map[string][]byte{"password": []byte("0ld")},
+		},
+	}}
+	a := &adminAPI{
+		cfg:         &config.Config{SecretLabel: "vault-injector"},
+		vault:       fv,
+		kr:          kr,
+		queue:       queue,
+		forceUpdate: make(chan config.UpdateInterface, 1),
+	}
+	return a, queue, fv
+}
+
+func serveAdmin(a *adminAPI, method, path string) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	a.routes(r)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+func TestAdminFollowerAnswers503(t *testing.T) {
+	// the queue only runs on the leader
+	a := &adminAPI{cfg: &config.Config{}, queue: &controller.WorkQueue{}}
+	for _, handler := range []http.HandlerFunc{a.secrets, a.resync, a.reload} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("follower answers %d", rec.Code)
+		}
+	}
+}
+
+func TestAdminSecrets(t *testing.T) {
+	a, queue, _ := newTestAdmin()
+	queue.status["dev/app"] = controller.SyncStatus{LastSync: time.Now()}
+	rec := serveAdmin(a, http.MethodGet, "/secrets")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "s3cret") || strings.Contains(body, "0ld") {
+		t.Fatalf("values returned: %s", body)
+	}
+	var infos []secretInfo
+	if err := json.NewDecoder(rec.Body).Decode(&infos); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"app": "synced", "new": "missing", "old": "not in map"}
+	if len(infos) != len(want) {
+		t.Fatalf("%d secrets, want %d: %+v", len(infos), len(want), infos)
+	}
+	for _, info := range infos {
+		if info.Status != want[info.Name] {
+			t.Errorf("%s status %q, want %q", info.Name, info.Status, want[info.Name])
+		}
+	}
+	if app := infos[0]; len(app.Paths) != 1 || app.Paths[0] != "projects/dev/db" || app.SourceVersions["projects/dev/db"] != 3 {
+		t.Errorf("dev/app = %+v", app)
+	}
+}
+
+func TestAdminSyncSecret(t *testing.T) {
+	a, queue, _ := newTestAdmin()
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/secrets/dev/app/sync", http.StatusAccepted},
+		{"/secrets/dev/new/sync", http.StatusAccepted},
+		{"/secrets/dev/gone/sync", http.StatusNotFound},
+	} {
+		if rec := serveAdmin(a, http.MethodPost, tc.path); rec.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.path, rec.Code, tc.want)
+		}
+	}
+	if len(queue.added) != 2 || queue.added[0] != "dev/app" || queue.added[1] != "dev/new" {
+		t.Errorf("queued %v", queue.added)
+	}
+}
+
+func TestAdminResyncNeverBlocks(t *testing.T) {
+	a, _, _ := newTestAdmin()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2; i++ {
+			if rec := serveAdmin(a, http.MethodPost, "/resync"); rec.Code != http.StatusAccepted {
+				t.Errorf("status %d", rec.Code)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("resync blocked with a resync pending")
+	}
+	if len(a.forceUpdate) != 1 {
+		t.Errorf("%d resyncs pending, want 1", len(a.forceUpdate))
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	a, _, fv := newTestAdmin()
+	if rec := serveAdmin(a, http.MethodPost, "/reload"); rec.Code != http.StatusOK {
+		t.Errorf("status %d for a good map", rec.Code)
+	}
+	fv.reloadErr = errors.New("line 2: dev/a: no data")
+	rec := serveAdmin(a, http.MethodPost, "/reload")
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "no data") {
+		t.Errorf("status %d, body %s, want 422 with the map error", rec.Code, rec.Body)
+	}
+}
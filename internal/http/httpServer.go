@@ -1,17 +1,25 @@
 package http
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/dig"
 	"go.uber.org/zap"
 	"net/http"
 	"vault-injector/config"
+	"vault-injector/internal/controller"
+	"vault-injector/internal/k8s"
+	"vault-injector/pkg/health"
 	middleware "vault-injector/pkg/middlewere"
+	"vault-injector/pkg/vault"
 )
 
 type WebServer interface {
 	Start()
+	Stop(ctx context.Context) error
 }
 
 type simpleServer struct {
@@ -20,26 +28,42 @@ type simpleServer struct {
 
 type ServerParams struct {
 	dig.In
-	config *config.Config //nolint
+
+	Config      *config.Config
+	Health      *health.Registry
+	Vault       vault.Service
+	Kr          k8s.KubeRepo
+	Queue       *controller.WorkQueue
+	ForceUpdate chan config.UpdateInterface
 }
 
-func NewWebServer(config *config.Config) WebServer {
+func NewWebServer(p ServerParams) WebServer {
+	config := p.Config
 
 	r := mux.NewRouter()
 
 	r.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "Ok")
 	})
-	r.HandleFunc("/readiness", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "Ok")
-	})
-	r.HandleFunc("/liveness", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "Ok")
-	})
+	r.HandleFunc("/readiness", p.Health.Handler(health.Readiness))
+	r.HandleFunc("/liveness", p.Health.Handler(health.Liveness))
 
-	r.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w, "Stop NotImplements", http.StatusMethodNotAllowed)
-	})
+	r.Handle("/metrics", promhttp.Handler())
+
+	if config.HTTP.AdminToken != "" {
+		admin := &adminAPI{
+			cfg:         config,
+			vault:       p.Vault,
+			kr:          p.Kr,
+			queue:       p.Queue,
+			forceUpdate: p.ForceUpdate,
+		}
+		adminRouter := r.PathPrefix(config.HTTP.RoutePrefix + "/admin").Subrouter()
+		adminRouter.Use(middleware.BearerAuth(string(config.HTTP.AdminToken)))
+		admin.routes(adminRouter)
+	} else {
+		zap.S().Info("HTTP_ADMIN_TOKEN is not set, admin API disabled")
+	}
 	r.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
 		panic("Panic NotImplemented")
 	})
@@ -59,10 +83,15 @@ func NewWebServer(config *config.Config) WebServer {
 
 func (s *simpleServer) Start() {
 	zap.S().Infof("starting server at %s", s.server.Addr)
-	go s.server.ListenAndServe()
+	go func() {
+		if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			zap.S().Errorf("http server: %v", err)
+		}
+	}()
 }
 
-func adminIndex(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, `<a href="/">site index</a>`)
-	fmt.Fprintln(w, "Admin area")
+// Stop lets open requests finish until ctx is done.
+func (s *simpleServer) Stop(ctx context.Context) error {
+	zap.S().Info("stopping http server")
+	return s.server.Shutdown(ctx)
 }
@@ -1,40 +1,65 @@
 package k8s
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"maps"
 	"reflect"
-	"strings"
+	"slices"
+	"sync"
 	"vault-injector/config"
+	"vault-injector/pkg/notify"
 	"vault-injector/pkg/vault"
 )
 
 type KubeRepo interface {
-	DeleteSecret(ctx context.Context, namespace, name string)
-	CreateEmptySecret(ctx context.Context, namespace, name string)
-	CreateDockerSecret(ctx context.Context, namespace, name string)
-	UpdateSecret(ctx context.Context, secret *v1.Secret)
+	DeleteSecret(ctx context.Context, secret *v1.Secret) error
+	CreateEmptySecret(ctx context.Context, namespace, name string) error
+	CreateSecret(ctx context.Context, namespace, name string) error
+	UpdateSecret(ctx context.Context, old, secret *v1.Secret) error
+	GetSecret(ctx context.Context, namespace, name string) (*v1.Secret, error)
 	GetSecretList(ctx context.Context) *v1.SecretList
-	WatchSecretList(ctx context.Context) watch.Interface
-	CompareSecret(ctx context.Context, secret *v1.Secret)
+	AddEventHandler(handler cache.ResourceEventHandler)
+	CompareSecret(ctx context.Context, secret *v1.Secret) error
+	PruneSecrets(ctx context.Context, secrets []v1.Secret)
+	IsOwnWrite(secret *v1.Secret) bool
 }
 
 type kubeRepo struct {
-	cfg   *config.Config
-	ks    KubeService
-	vault vault.Service
+	cfg      *config.Config
+	ks       KubeService
+	vault    vault.Service
+	notifier notify.Notifier
+	// written holds the resourceVersion of the last synced write per
+	// namespace/name, to recognise the watch events caused by it.
+	written     map[string]string
+	writtenLock sync.Mutex
+	// failedRollouts holds the workloads, by kind/name, whose rollout patch
+	// failed per namespace/name of the secret.
+	failedRollouts map[string]map[string]bool
+	rolloutLock    sync.Mutex
 }
 
-func NewKubeRepo(ks KubeService, cfg *config.Config, vault vault.Service) KubeRepo {
-	return &kubeRepo{
-		cfg:   cfg,
-		ks:    ks,
-		vault: vault,
+func NewKubeRepo(ks KubeService, cfg *config.Config, vault vault.Service, notifier notify.Notifier) KubeRepo {
+	if !validPrunePolicy(cfg.PrunePolicy) {
+		zap.S().Fatalf("unknown PRUNE_POLICY %q, use %s, %s or %s", cfg.PrunePolicy, PrunePolicyDelete, PrunePolicyOrphan, PrunePolicyKeep)
 	}
+	kr := &kubeRepo{
+		cfg:      cfg,
+		ks:       ks,
+		vault:    vault,
+		notifier: notifier,
+		written:  make(map[string]string),
+	}
+	vault.OnMapError(kr.mapErrorEvents)
+	return kr
 }
 
 func (kr *kubeRepo) GetSecretList(ctx context.Context) *v1.SecretList {
@@ -46,95 +71,331 @@ func (kr *kubeRepo) GetSecretList(ctx context.Context) *v1.SecretList {
 	return serviceList
 }
 
-func (kr *kubeRepo) WatchSecretList(ctx context.Context) watch.Interface {
-	serviceList, err := kr.ks.WatchSecretList(ctx)
-	if err != nil {
-		zap.S().Errorf("error WatchSecretList: %v", err)
-		return nil
+// GetSecret returns a copy of the managed secret from the informer cache, or
+// nil when there is none.
+func (kr *kubeRepo) GetSecret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	return kr.ks.GetSecret(ctx, namespace, name)
+}
+
+func (kr *kubeRepo) AddEventHandler(handler cache.ResourceEventHandler) {
+	if err := kr.ks.AddEventHandler(handler); err != nil {
+		zap.S().Errorf("error AddEventHandler: %v", err)
 	}
-	return serviceList
 }
 
-func (kr *kubeRepo) DeleteSecret(ctx context.Context, namespace, name string) {
-	err := kr.ks.DeleteSecret(ctx, namespace, name)
+func (kr *kubeRepo) DeleteSecret(ctx context.Context, secret *v1.Secret) error {
+	if !kr.dryRun("delete", secret, nil) {
+		return nil
+	}
+	err := kr.ks.DeleteSecret(ctx, secret.Namespace, secret.Name)
 	if err != nil {
-		zap.S().Errorf("error GetSecretList: %v", err)
+		zap.S().Errorf("error DeleteSecret: %v", err)
+		kr.event(secret, v1.EventTypeWarning, ReasonSyncFailed, "delete failed: %v", err)
+	} else {
+		kr.event(secret, v1.EventTypeNormal, ReasonDeleted, "deleted by %s", kr.cfg.InstanceName)
 	}
+	kr.writtenLock.Lock()
+	delete(kr.written, secret.Namespace+"/"+secret.Name)
+	kr.writtenLock.Unlock()
+	kr.setFailedRollouts(secret.Namespace+"/"+secret.Name, nil)
+	return err
 }
 
-func (kr *kubeRepo) UpdateSecret(ctx context.Context, secret *v1.Secret) {
-	err := kr.ks.UpdateSecret(ctx, secret)
+// UpdateSecret writes secret, old is the secret as it was read and is only
+// used for the dry-run diff.
+func (kr *kubeRepo) UpdateSecret(ctx context.Context, old, secret *v1.Secret) error {
+	if !kr.dryRun("update", old, secret) {
+		return nil
+	}
+	written, err := kr.ks.UpdateSecret(ctx, secret)
 	if err != nil {
 		zap.S().Errorf("error UpdateSecret: %v", err)
+		kr.event(secret, v1.EventTypeWarning, ReasonSyncFailed, "update failed: %v", err)
+		return err
 	}
+	kr.event(written, v1.EventTypeNormal, ReasonUpdated, "updated by %s", kr.cfg.InstanceName)
+	kr.remember(written)
+	return nil
 }
 
-func (kr *kubeRepo) _newSecret(namespace, name string, _type v1.SecretType) *v1.Secret {
-	labels := map[string]string{
-		kr.cfg.SecretLabel + "/sync": "true",
+// remember records a write of synced content. Empty secrets are not
+// recorded, their add event is what fills them.
+func (kr *kubeRepo) remember(secret *v1.Secret) {
+	if kr.cfg.DryRun || secret.Annotations[kr.cfg.SecretLabel+"/checksum"] == "" {
+		return
 	}
+	kr.writtenLock.Lock()
+	defer kr.writtenLock.Unlock()
+	kr.written[secret.Namespace+"/"+secret.Name] = secret.ResourceVersion
+}
+
+// IsOwnWrite reports whether the secret is exactly what this process wrote
+// last, so its watch event needs no vault read.
+func (kr *kubeRepo) IsOwnWrite(secret *v1.Secret) bool {
+	kr.writtenLock.Lock()
+	defer kr.writtenLock.Unlock()
+	key := secret.Namespace + "/" + secret.Name
+	resourceVersion, ok := kr.written[key]
+	if !ok {
+		return false
+	}
+	if resourceVersion != secret.ResourceVersion {
+		delete(kr.written, key)
+		return false
+	}
+	return true
+}
 
-	return &v1.Secret{
+func (kr *kubeRepo) _newSecret(secretCfg vault.Secret) *v1.Secret {
+	secret := &v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      name,
-			Namespace: namespace,
-			Labels:    labels,
+			Name:      secretCfg.Name,
+			Namespace: secretCfg.Namespace,
 		},
-		Type: _type,
+		Type: secretCfg.Type,
 	}
+	kr.applyMeta(secret, secretCfg)
+	return secret
 }
 
-func (kr *kubeRepo) NewSecret(namespace, name string) *v1.Secret {
-	return kr._newSecret(namespace, name, v1.SecretTypeOpaque)
+// applyMeta merges labels, annotations and immutable from the map into the
+// secret, marks it as owned by this instance and reports whether anything
+// changed.
+func (kr *kubeRepo) applyMeta(secret *v1.Secret, secretCfg vault.Secret) bool {
+	changed := false
+	if secret.Labels == nil {
+		secret.Labels = make(map[string]string)
+	}
+	labels := maps.Clone(secretCfg.Labels)
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[kr.cfg.SecretLabel+"/sync"] = "true"
+	for k, v := range labels {
+		if secret.Labels[k] != v {
+			secret.Labels[k] = v
+			changed = true
+		}
+	}
+	annotations := maps.Clone(secretCfg.Annotations)
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[kr.cfg.SecretLabel+"/owner"] = kr.cfg.InstanceName
+	annotations[kr.cfg.SecretLabel+"/map-source"] = kr.cfg.SecretMap
+	for k, v := range annotations {
+		if secret.Annotations == nil {
+			secret.Annotations = make(map[string]string)
+		}
+		if secret.Annotations[k] != v {
+			secret.Annotations[k] = v
+			changed = true
+		}
+	}
+	if secretCfg.Immutable && (secret.Immutable == nil || !*secret.Immutable) {
+		secret.Immutable = &secretCfg.Immutable
+		changed = true
+	}
+	return changed
 }
 
-func (kr *kubeRepo) NewDockerSecret(namespace, name string, data map[string][]byte) *v1.Secret {
-	secret := kr._newSecret(namespace, name, v1.SecretTypeDockerConfigJson)
+func (kr *kubeRepo) NewSecret(secretCfg vault.Secret, data map[string][]byte) *v1.Secret {
+	secret := kr._newSecret(secretCfg)
 	secret.Data = data
 	return secret
 }
 
-func (kr *kubeRepo) CompareSecret(ctx context.Context, secret *v1.Secret) {
-	var data map[string][]byte
-	var err error
-	if strings.Contains(secret.Name, "dockerconfigjson") {
-		data, err = kr.vault.GetDockerData(ctx, secret.Namespace, secret.Name)
-	} else {
-		data, err = kr.vault.GetData(ctx, secret.Namespace, secret.Name)
+// CompareSecret brings the secret in line with vault and the map. Errors are
+// returned so the caller can retry.
+func (kr *kubeRepo) CompareSecret(ctx context.Context, secret *v1.Secret) error {
+	ctx = vault.EnsureReadCache(ctx)
+	secretCfg, ok := kr.vault.GetSecretCfg(secret.Namespace, secret.Name)
+	if !ok {
+		zap.S().Infof("%s(%s) no in secretMap - SKIP, left to prune", secret.Namespace, secret.Name)
+		return nil
 	}
-
-	if data == nil {
-		zap.S().Infof("%s(%s) no in secretMap - DELETE", secret.Namespace, secret.Name)
-		kr.DeleteSecret(ctx, secret.Namespace, secret.Name)
-		return
+	if owner := secret.Annotations[kr.cfg.SecretLabel+"/owner"]; owner != "" && owner != kr.cfg.InstanceName {
+		zap.S().Warnf("%s(%s) owned by %q - SKIP", secret.Namespace, secret.Name, owner)
+		kr.event(secret, v1.EventTypeWarning, ReasonOwnerConflict, "in the map of %s, but owned by %s", kr.cfg.InstanceName, owner)
+		return nil
+	}
+	info := fmt.Sprintf("%s(%s) check for update", secret.Namespace, secret.Name)
+	versions, _ := kr.vault.GetVersions(ctx, secret.Namespace, secret.Name) //nolint:errcheck
+	// secrets written before the owner annotation existed have none, they
+	// fall through and are adopted by applyMeta
+	if versions != nil && kr.isOwned(secret) && kr.isSynced(secret, secretCfg, versions) {
+		zap.S().Infof("%s - UNCHANGED", info)
+		return kr.healRollout(ctx, secret, secretCfg)
 	}
+
+	data, err := kr.getData(ctx, secretCfg, secret.Data)
 	if err != nil {
 		zap.S().Infof("%s(%s) GetSecret error - SKIP", secret.Namespace, secret.Name)
-		return
+		kr.event(secret, v1.EventTypeWarning, ReasonVaultReadFailed, "vault read failed: %v", err)
+		return err
 	}
-	info := fmt.Sprintf("%s(%s) check for update", secret.Namespace, secret.Name)
-	if reflect.DeepEqual(secret.Data, data) {
+	versions = kr.dataVersions(ctx, secretCfg)
+	equals := reflect.DeepEqual(secret.Data, data)
+	if secret.Type != secretCfg.Type || (!equals && secret.Immutable != nil && *secret.Immutable) {
+		zap.S().Infof("%s - RECREATE (type %s, immutable)", info, secret.Type)
+		if err := kr.DeleteSecret(ctx, secret); err != nil {
+			return err
+		}
+		newSecret := kr.NewSecret(secretCfg, data)
+		kr.setSyncAnnotations(newSecret, secretCfg, versions)
+		if kr.cfg.DryRun && kr.cfg.DryRunServer {
+			// the server kept the secret on the dry run delete, a create
+			// could only fail with AlreadyExists
+			kr.dryRun("create", nil, newSecret)
+			return nil
+		}
+		if err := kr.createSecret(ctx, newSecret); err != nil {
+			return err
+		}
+		if secretCfg.Rollout && !equals {
+			return kr.rollout(ctx, newSecret)
+		}
+		return nil
+	}
+	newSecret := secret.DeepCopy()
+	metaChanged := kr.applyMeta(newSecret, secretCfg)
+	if equals && !metaChanged && kr.isSynced(secret, secretCfg, versions) {
 		zap.S().Infof("%s - EQUALS", info)
+		return kr.healRollout(ctx, secret, secretCfg)
+	}
+	newSecret.Data = data
+	kr.setSyncAnnotations(newSecret, secretCfg, versions)
+	zap.S().Infof("%s - NOT EQUALS", info)
+	if err := kr.UpdateSecret(ctx, secret, newSecret); err != nil {
+		return err
+	}
+	// filling a fresh empty secret is not a change worth a rollout
+	if secretCfg.Rollout && !equals && len(secret.Data) > 0 {
+		return kr.rollout(ctx, newSecret)
+	}
+	return nil
+}
+
+func (kr *kubeRepo) getData(ctx context.Context, secretCfg vault.Secret, current map[string][]byte) (map[string][]byte, error) {
+	switch {
+	case secretCfg.Type == v1.SecretTypeDockerConfigJson:
+		return kr.vault.GetDockerData(ctx, secretCfg.Namespace, secretCfg.Name)
+	case secretCfg.PKI != nil:
+		return kr.vault.GetTLSData(ctx, secretCfg.Namespace, secretCfg.Name, current)
+	default:
+		return kr.vault.GetData(ctx, secretCfg.Namespace, secretCfg.Name)
+	}
+}
+
+// dataVersions returns the versions of the data getData just read with ctx,
+// they come from the read cache. Reading them before the data could pair an
+// older value with a newer version and hide the change until the next write.
+func (kr *kubeRepo) dataVersions(ctx context.Context, secretCfg vault.Secret) map[string]int {
+	versions, _ := kr.vault.GetVersions(ctx, secretCfg.Namespace, secretCfg.Name) //nolint:errcheck
+	return versions
+}
+
+// isSynced reports whether the secret was written from the given vault
+// versions with the current mapping and has not been edited since. Nil
+// versions (metadata unavailable) only check the checksum.
+func (kr *kubeRepo) isSynced(secret *v1.Secret, secretCfg vault.Secret, versions map[string]int) bool {
+	if versions != nil && secret.Annotations[kr.cfg.SecretLabel+"/source-versions"] != encodeVersions(versions) {
+		return false
+	}
+	return secret.Annotations[kr.cfg.SecretLabel+"/checksum"] == checksum(secretCfg, secret.Data)
+}
+
+func (kr *kubeRepo) setSyncAnnotations(secret *v1.Secret, secretCfg vault.Secret, versions map[string]int) {
+	if secret.Annotations == nil {
+		secret.Annotations = make(map[string]string)
+	}
+	if versions == nil {
+		delete(secret.Annotations, kr.cfg.SecretLabel+"/source-versions")
 	} else {
-		secret.Data = data
-		zap.S().Infof("%s - NOT EQUALS", info)
-		kr.UpdateSecret(ctx, secret)
+		secret.Annotations[kr.cfg.SecretLabel+"/source-versions"] = encodeVersions(versions)
 	}
+	secret.Annotations[kr.cfg.SecretLabel+"/checksum"] = checksum(secretCfg, secret.Data)
 }
 
-func (kr *kubeRepo) CreateEmptySecret(ctx context.Context, namespace, name string) {
-	secret := kr.NewSecret(namespace, name)
-	err := kr.ks.CreateSecret(ctx, secret)
+func encodeVersions(versions map[string]int) string {
+	if versions == nil {
+		return ""
+	}
+	b, _ := json.Marshal(versions) //nolint:errcheck
+	return string(b)
+}
+
+// checksum hashes the mapping together with the secret data, so a changed
+// map.yaml or a manual edit of the secret forces a full vault read.
+func checksum(secretCfg vault.Secret, data map[string][]byte) string {
+	h := sha256.New()
+	b, _ := json.Marshal(secretCfg) //nolint:errcheck
+	h.Write(b)
+	keys := slices.Sorted(maps.Keys(data))
+	for _, k := range keys {
+		h.Write([]byte(k + "\n"))
+		h.Write(data[k])
+		h.Write([]byte("\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (kr *kubeRepo) CreateEmptySecret(ctx context.Context, namespace, name string) error {
+	secretCfg, ok := kr.vault.GetSecretCfg(namespace, name)
+	if !ok {
+		return nil
+	}
+	return kr.createSecret(ctx, kr.NewSecret(secretCfg, nil))
+}
+
+// CreateSecret creates the secret together with its data. Types with
+// required keys (tls, dockerconfigjson, basic-auth, ...) and immutable
+// secrets can't be created empty.
+func (kr *kubeRepo) CreateSecret(ctx context.Context, namespace, name string) error {
+	secretCfg, ok := kr.vault.GetSecretCfg(namespace, name)
+	if !ok {
+		return nil
+	}
+	ctx = vault.EnsureReadCache(ctx)
+	data, err := kr.getData(ctx, secretCfg, nil)
+	if err != nil {
+		zap.S().Errorf("error CreateSecret: %v", err)
+		return err
+	}
+	secret := kr.NewSecret(secretCfg, data)
+	kr.setSyncAnnotations(secret, secretCfg, kr.dataVersions(ctx, secretCfg))
+	return kr.createSecret(ctx, secret)
+}
+
+func (kr *kubeRepo) createSecret(ctx context.Context, secret *v1.Secret) error {
+	if !kr.dryRun("create", nil, secret) {
+		return nil
+	}
+	written, err := kr.ks.CreateSecret(ctx, secret)
 	if err != nil {
-		zap.S().Errorf("error CreateEmptySecret: %v", err)
+		zap.S().Errorf("error CreateSecret: %v", err)
+		return err
 	}
+	kr.event(written, v1.EventTypeNormal, ReasonCreated, "created by %s", kr.cfg.InstanceName)
+	kr.remember(written)
+	return nil
 }
 
-func (kr *kubeRepo) CreateDockerSecret(ctx context.Context, namespace, name string) {
-	data, err := kr.vault.GetDockerData(ctx, namespace, name)
-	secret := kr.NewDockerSecret(namespace, name, data)
-	err = kr.ks.CreateSecret(ctx, secret)
+// RenderSecret builds the secret exactly as the daemon would create it,
+// without talking to kubernetes.
+func RenderSecret(ctx context.Context, cfg *config.Config, vs vault.Service, namespace, name string) (*v1.Secret, error) {
+	kr := &kubeRepo{cfg: cfg, vault: vs}
+	secretCfg, ok := vs.GetSecretCfg(namespace, name)
+	if !ok {
+		return nil, fmt.Errorf("%s/%s not in secret map", namespace, name)
+	}
+	ctx = vault.EnsureReadCache(ctx)
+	data, err := kr.getData(ctx, secretCfg, nil)
 	if err != nil {
-		zap.S().Errorf("error CreateEmptyDockerSecret: %v", err)
+		return nil, err
 	}
+	secret := kr.NewSecret(secretCfg, data)
+	kr.setSyncAnnotations(secret, secretCfg, kr.dataVersions(ctx, secretCfg))
+	secret.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"}
+	return secret, nil
 }
@@ -0,0 +1,76 @@
+package k8s
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"maps"
+	"slices"
+)
+
+// dryRun logs the diff of a mutating call when DRY_RUN is set and reports
+// whether the call has to go to the API server. With DRY_RUN_SERVER the
+// call is still sent, kubeService marks it as a server-side dry run so
+// admission errors show up.
+func (kr *kubeRepo) dryRun(action string, old, secret *v1.Secret) bool {
+	if !kr.cfg.DryRun {
+		return true
+	}
+	var oldData, newData map[string][]byte
+	target := secret
+	if old != nil {
+		oldData = old.Data
+		target = old
+	}
+	if secret != nil {
+		newData = secret.Data
+	}
+	added, removed, changed := diffData(oldData, newData)
+	zap.S().Infow("dry-run",
+		"action", action,
+		"namespace", target.Namespace,
+		"name", target.Name,
+		"added", added,
+		"removed", removed,
+		"changed", changed,
+	)
+	return kr.cfg.DryRunServer
+}
+
+// diffData compares secret data. Values are never printed, only a short
+// hmac of them, keyed per process so low entropy values can't be guessed
+// offline from the logs.
+func diffData(old, new map[string][]byte) (added, removed, changed []string) {
+	for _, k := range slices.Sorted(maps.Keys(new)) {
+		oldValue, ok := old[k]
+		switch {
+		case !ok:
+			added = append(added, k+"="+hashValue(new[k]))
+		case string(oldValue) != string(new[k]):
+			changed = append(changed, k+"="+hashValue(oldValue)+"->"+hashValue(new[k]))
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(old)) {
+		if _, ok := new[k]; !ok {
+			removed = append(removed, k+"="+hashValue(old[k]))
+		}
+	}
+	return added, removed, changed
+}
+
+var hashKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+func hashValue(value []byte) string {
+	h := hmac.New(sha256.New, hashKey)
+	h.Write(value) //nolint:errcheck
+	return "hmac:" + hex.EncodeToString(h.Sum(nil))[:12]
+}
@@ -0,0 +1,42 @@
+package k8s
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiffData(t *testing.T) {
+	old := map[string][]byte{"user": []byte("app"), "pass": []byte("old"), "gone": []byte("x")}
+	new := map[string][]byte{"user": []byte("app"), "pass": []byte("new"), "host": []byte("db")}
+	added, removed, changed := diffData(old, new)
+	if len(added) != 1 || !strings.HasPrefix(added[0], "host=hmac:") {
+		t.Errorf("added = %q", added)
+	}
+	if len(removed) != 1 || !strings.HasPrefix(removed[0], "gone=hmac:") {
+		t.Errorf("removed = %q", removed)
+	}
+	if len(changed) != 1 || changed[0] != "pass="+hashValue([]byte("old"))+"->"+hashValue([]byte("new")) {
+		t.Errorf("changed = %q", changed)
+	}
+	for _, entry := range slices.Concat(added, removed, changed) {
+		for _, value := range []string{"db", "x", "old", "new"} {
+			if strings.Contains(entry, "="+value) {
+				t.Errorf("value %q leaked in %q", value, entry)
+			}
+		}
+	}
+}
+
+func TestHashValueIsKeyed(t *testing.T) {
+	value := []byte("1234")
+	if hashValue(value) != hashValue(value) {
+		t.Error("hash differs for the same value")
+	}
+	plain := sha256.Sum256(value)
+	if strings.Contains(hashValue(value), hex.EncodeToString(plain[:])[:12]) {
+		t.Error("hash is a plain sha256 of the value")
+	}
+}
@@ -0,0 +1,47 @@
+package k8s
+
+import (
+	"context"
+	v1 "k8s.io/api/core/v1"
+	"strings"
+)
+
+// Reasons of the events recorded on managed secrets.
+const (
+	ReasonCreated         = "Created"
+	ReasonUpdated         = "Updated"
+	ReasonDeleted         = "Deleted"
+	ReasonOrphaned        = "Orphaned"
+	ReasonRolledOut       = "RolledOut"
+	ReasonSyncFailed      = "SyncFailed"
+	ReasonVaultReadFailed = "VaultReadFailed"
+	ReasonMapError        = "MapError"
+	ReasonOwnerConflict   = "OwnerConflict"
+)
+
+// event records a kubernetes event on the secret, so it shows up in
+// `kubectl describe secret`. Repeated events are aggregated by the recorder.
+// Nothing is recorded in dry-run mode.
+func (kr *kubeRepo) event(secret *v1.Secret, eventType, reason, messageFmt string, args ...interface{}) {
+	if kr.ks == nil || kr.cfg.DryRun {
+		return
+	}
+	kr.ks.GetRecorder().Eventf(secret, eventType, reason, messageFmt, args...)
+}
+
+// mapErrorEvents records the problems of a rejected map on the managed
+// secrets they belong to. The informer only runs on the leader, followers
+// have no secrets to record them on.
+func (kr *kubeRepo) mapErrorEvents() {
+	secretList := kr.GetSecretList(context.Background())
+	if secretList == nil {
+		return
+	}
+	for i := range secretList.Items {
+		secret := &secretList.Items[i]
+		if errs := kr.vault.GetMapErrors(secret.Namespace, secret.Name); len(errs) > 0 {
+			kr.event(secret, v1.EventTypeWarning, ReasonMapError, "secret map %s rejected, the last good one is used: %s",
+				kr.cfg.SecretMap, strings.Join(errs, "; "))
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package k8s
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"strings"
+	"testing"
+	"vault-injector/pkg/notify"
+)
+
+func TestMapErrorEvents(t *testing.T) {
+	cfg := testConfig()
+	cfg.SecretMap = "map.yaml"
+	ks := &fakeKube{secrets: []v1.Secret{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "app"}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "db"}},
+	}}
+	kr := &kubeRepo{cfg: cfg, ks: ks, notifier: notify.Discard,
+		vault: &fakeVault{mapErrors: map[string][]string{"dev/db": {`line 4: dev/db: unknown field "pth"`}}}}
+	kr.mapErrorEvents()
+
+	events := ks.GetRecorder().(*record.FakeRecorder).Events
+	if len(events) != 1 {
+		t.Fatalf("%d events, want 1", len(events))
+	}
+	if event := <-events; !strings.HasPrefix(event, v1.EventTypeWarning+" "+ReasonMapError) || !strings.Contains(event, "pth") {
+		t.Errorf("event %q", event)
+	}
+}
+
+func TestMapErrorEventsDryRun(t *testing.T) {
+	cfg := testConfig()
+	cfg.DryRun = true
+	ks := &fakeKube{secrets: []v1.Secret{{ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "db"}}}}
+	kr := &kubeRepo{cfg: cfg, ks: ks, notifier: notify.Discard,
+		vault: &fakeVault{mapErrors: map[string][]string{"dev/db": {"line 4: dev/db: path missing"}}}}
+	kr.mapErrorEvents()
+	if events := ks.GetRecorder().(*record.FakeRecorder).Events; len(events) != 0 {
+		t.Errorf("%d events recorded in dry-run", len(events))
+	}
+}
@@ -0,0 +1,101 @@
+package k8s
+
+import (
+	"context"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"maps"
+	"vault-injector/config"
+	"vault-injector/pkg/vault"
+)
+
+// fakeKube records writes, calls outside the overrides panic.
+type fakeKube struct {
+	KubeService
+	deleted   []string
+	updated   []*v1.Secret
+	workloads []Workload
+	patched   []string
+	patchErr  error
+	listed    int
+	secrets   []v1.Secret
+	recorder  *record.FakeRecorder
+}
+
+func (f *fakeKube) DeleteSecret(ctx context.Context, namespace, name string) error {
+	f.deleted = append(f.deleted, namespace+"/"+name)
+	return nil
+}
+
+func (f *fakeKube) UpdateSecret(ctx context.Context, secret *v1.Secret) (*v1.Secret, error) {
+	f.updated = append(f.updated, secret)
+	return secret, nil
+}
+
+func (f *fakeKube) ListWorkloads(ctx context.Context, namespace string) ([]Workload, error) {
+	f.listed++
+	return f.workloads, nil
+}
+
+func (f *fakeKube) PatchWorkload(ctx context.Context, workload Workload, patch []byte) error {
+	if f.patchErr != nil {
+		return f.patchErr
+	}
+	f.patched = append(f.patched, workload.Name)
+	return nil
+}
+
+func (f *fakeKube) GetSecretList(ctx context.Context) (*v1.SecretList, error) {
+	return &v1.SecretList{Items: f.secrets}, nil
+}
+
+func (f *fakeKube) GetRecorder() record.EventRecorder {
+	if f.recorder == nil {
+		f.recorder = record.NewFakeRecorder(100)
+	}
+	return f.recorder
+}
+
+// fakeVault knows the map by namespace/name.
+type fakeVault struct {
+	vault.Service
+	secrets   map[string]bool
+	cfgs      map[string]vault.Secret
+	versions  map[string]int
+	mapErrors map[string][]string
+	data      map[string][]byte
+	reads     int
+}
+
+func (f *fakeVault) IsNeedSecret(namespaceAndName string) bool {
+	return f.secrets[namespaceAndName]
+}
+
+func (f *fakeVault) GetSecretCfg(namespace, name string) (vault.Secret, bool) {
+	secret, ok := f.cfgs[namespace+"/"+name]
+	return secret, ok
+}
+
+func (f *fakeVault) GetMapErrors(namespace, name string) []string {
+	return f.mapErrors[namespace+"/"+name]
+}
+
+func (f *fakeVault) GetData(ctx context.Context, namespace, name string) (map[string][]byte, error) {
+	f.reads++
+	return maps.Clone(f.data), nil
+}
+
+func (f *fakeVault) GetVersions(ctx context.Context, namespace, name string) (map[string]int, error) {
+	return f.versions, nil
+}
+
+func testConfig() *config.Config {
+	cfg := &config.Config{
+		SecretLabel:     "vault-injector",
+		InstanceName:    "vault-injector",
+		PrunePolicy:     PrunePolicyDelete,
+		PruneMaxPercent: 30,
+		PruneMinCount:   3,
+	}
+	return cfg
+}
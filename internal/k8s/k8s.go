@@ -2,56 +2,100 @@ package k8s
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/homedir"
 	"path/filepath"
 	"sync"
+	"time"
 	"vault-injector/config"
+	"vault-injector/pkg/health"
+	"vault-injector/pkg/metrics"
 )
 
 type KubeService interface {
+	Start(ctx context.Context) error
+	RunLeaderElection(ctx context.Context, run func(ctx context.Context))
+	GetSecret(ctx context.Context, namespace, name string) (*v1.Secret, error)
 	GetSecretList(ctx context.Context) (*v1.SecretList, error)
-	CreateSecret(ctx context.Context, secret *v1.Secret) error
-	UpdateSecret(ctx context.Context, secret *v1.Secret) error
+	CreateSecret(ctx context.Context, secret *v1.Secret) (*v1.Secret, error)
+	UpdateSecret(ctx context.Context, secret *v1.Secret) (*v1.Secret, error)
 	DeleteSecret(ctx context.Context, namespace, name string) error
-	WatchSecretList(ctx context.Context) (watch.Interface, error)
+	AddEventHandler(handler cache.ResourceEventHandler) error
+	ListWorkloads(ctx context.Context, namespace string) ([]Workload, error)
+	PatchWorkload(ctx context.Context, workload Workload, patch []byte) error
+	GetRecorder() record.EventRecorder
 	GetToken() string
 	GetCA() []byte
 }
 
 type kubeService struct {
-	Cfg             *config.Config
-	k8sConfig       *rest.Config
-	clientSet       *kubernetes.Clientset
-	resourceVersion string
-	labelSelector   *metav1.LabelSelector
-	sync.Mutex
+	Cfg       *config.Config
+	k8sConfig *rest.Config
+	clientSet *kubernetes.Clientset
+	factory   informers.SharedInformerFactory
+	informer  cache.SharedIndexInformer
+	lister    corelisters.SecretLister
+	recorder  record.EventRecorder
+	health    *health.Registry
+	// watchErrors are the times of recent watch failures, for the health check.
+	watchErrors  []time.Time
+	lastWatchErr error
+	watchLock    sync.Mutex
 }
 
-func NewKubeService(cfg *config.Config) KubeService {
+const (
+	watchErrorWindow = 5 * time.Minute
+	watchErrorLimit  = 3
+)
+
+func NewKubeService(cfg *config.Config, health *health.Registry) KubeService {
 	k8sConfig := getConfig(cfg.InCluster, cfg.Kubeconfig)
 	clientSet, err := kubernetes.NewForConfig(k8sConfig)
 	if err != nil {
 		zap.S().Fatal(err)
 	}
-	labelSelector := &metav1.LabelSelector{MatchLabels: map[string]string{cfg.SecretLabel + "/sync": "true"}}
+	factory, informer, lister := secretInformer(clientSet, cfg.SecretLabel)
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientSet.CoreV1().Events("")})
 	return &kubeService{
-		Cfg:             cfg,
-		k8sConfig:       k8sConfig,
-		clientSet:       clientSet,
-		labelSelector:   labelSelector,
-		resourceVersion: "0",
+		Cfg:       cfg,
+		k8sConfig: k8sConfig,
+		clientSet: clientSet,
+		factory:   factory,
+		informer:  informer,
+		lister:    lister,
+		recorder:  broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: cfg.InstanceName}),
+		health:    health,
 	}
 }
 
+// secretInformer watches only the secrets labelled <label>/sync=true.
+func secretInformer(clientSet kubernetes.Interface, label string) (informers.SharedInformerFactory, cache.SharedIndexInformer, corelisters.SecretLister) {
+	selector := labels.Set{label + "/sync": "true"}.String()
+	factory := informers.NewSharedInformerFactoryWithOptions(clientSet, 0,
+		informers.WithTweakListOptions(func(opt *metav1.ListOptions) {
+			opt.LabelSelector = selector
+		}))
+	secrets := factory.Core().V1().Secrets()
+	return factory, secrets.Informer(), secrets.Lister()
+}
+
 func getConfig(inCluster bool, kubeconfig string) *rest.Config {
 	var config *rest.Config
 	var err error
@@ -74,6 +118,10 @@ func getConfig(inCluster bool, kubeconfig string) *rest.Config {
 	}
 	return config
 }
+func (k *kubeService) GetRecorder() record.EventRecorder {
+	return k.recorder
+}
+
 func (k *kubeService) GetToken() string {
 	return k.k8sConfig.BearerToken
 }
@@ -82,40 +130,106 @@ func (k *kubeService) GetCA() []byte {
 	return k.k8sConfig.TLSClientConfig.CAData
 }
 
-func (k *kubeService) GetSecretList(ctx context.Context) (*v1.SecretList, error) {
-	k.Lock()
-	defer k.Unlock()
-	opt := metav1.ListOptions{LabelSelector: labels.Set(k.labelSelector.MatchLabels).String()}
-	n, err := k.clientSet.CoreV1().Secrets("").List(ctx, opt)
-	k.resourceVersion = n.GetResourceVersion()
-	return n, err
+// Start runs the secret informer and waits for the first list, so the
+// lister is complete before any controller reads from it. Relists after a
+// watch expiry (410 Gone) are handled by the informer.
+func (k *kubeService) Start(ctx context.Context) error {
+	err := k.informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		metrics.WatchRestarts.Inc()
+		k.watchLock.Lock()
+		k.watchErrors = append(k.watchErrors, time.Now())
+		k.lastWatchErr = err
+		k.watchLock.Unlock()
+		cache.DefaultWatchErrorHandler(r, err)
+	})
+	if err != nil {
+		return err
+	}
+	k.health.Register("watch", health.Readiness, k.checkWatch)
+	k.factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), k.informer.HasSynced) {
+		return errors.New("secret informer cache sync failed")
+	}
+	zap.S().Info("secret informer synced")
+	return nil
 }
 
-func (k *kubeService) WatchSecretList(ctx context.Context) (watch.Interface, error) {
-	k.Lock()
-	defer k.Unlock()
-	opt := metav1.ListOptions{LabelSelector: labels.Set(k.labelSelector.MatchLabels).String(), ResourceVersion: k.resourceVersion}
-	w, err := k.clientSet.CoreV1().Secrets("").Watch(ctx, opt)
-	return w, err
+// checkWatch fails until the informer synced and while the watch keeps
+// failing, watchErrorLimit times within watchErrorWindow.
+func (k *kubeService) checkWatch() error {
+	if !k.informer.HasSynced() {
+		return errors.New("secret informer not synced")
+	}
+	k.watchLock.Lock()
+	defer k.watchLock.Unlock()
+	since := time.Now().Add(-watchErrorWindow)
+	for len(k.watchErrors) > 0 && k.watchErrors[0].Before(since) {
+		k.watchErrors = k.watchErrors[1:]
+	}
+	if len(k.watchErrors) >= watchErrorLimit {
+		return fmt.Errorf("%d watch failures in %s, last: %v", len(k.watchErrors), watchErrorWindow, k.lastWatchErr)
+	}
+	return nil
 }
 
-func (k *kubeService) DeleteSecret(ctx context.Context, namespace, name string) error {
-	k.Lock()
-	defer k.Unlock()
-	err := k.clientSet.CoreV1().Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{})
-	return err
+// GetSecretList returns managed secrets from the informer cache. Items are
+// copies, so callers may modify them.
+func (k *kubeService) GetSecretList(_ context.Context) (*v1.SecretList, error) {
+	secrets, err := k.lister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	list := &v1.SecretList{Items: make([]v1.Secret, 0, len(secrets))}
+	for _, secret := range secrets {
+		list.Items = append(list.Items, *secret.DeepCopy())
+	}
+	return list, nil
+}
+
+// GetSecret returns a copy of the secret from the informer cache, or nil when
+// it is not there.
+func (k *kubeService) GetSecret(_ context.Context, namespace, name string) (*v1.Secret, error) {
+	secret, err := k.lister.Secrets(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return secret.DeepCopy(), nil
 }
 
-func (k *kubeService) UpdateSecret(ctx context.Context, secret *v1.Secret) error {
-	k.Lock()
-	defer k.Unlock()
-	_, err := k.clientSet.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+func (k *kubeService) AddEventHandler(handler cache.ResourceEventHandler) error {
+	_, err := k.informer.AddEventHandler(handler)
 	return err
 }
 
-func (k *kubeService) CreateSecret(ctx context.Context, secret *v1.Secret) error {
-	k.Lock()
-	defer k.Unlock()
-	_, err := k.clientSet.CoreV1().Secrets(secret.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+// dryRun returns the DryRun option for mutating calls, set when DRY_RUN and
+// DRY_RUN_SERVER ask for a server-side dry run.
+func (k *kubeService) dryRun() []string {
+	if k.Cfg.DryRun && k.Cfg.DryRunServer {
+		return []string{metav1.DryRunAll}
+	}
+	return nil
+}
+
+func (k *kubeService) DeleteSecret(ctx context.Context, namespace, name string) error {
+	start := time.Now()
+	err := k.clientSet.CoreV1().Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{DryRun: k.dryRun()})
+	metrics.ObserveKube("delete", start, err)
 	return err
 }
+
+func (k *kubeService) UpdateSecret(ctx context.Context, secret *v1.Secret) (*v1.Secret, error) {
+	start := time.Now()
+	secret, err := k.clientSet.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{DryRun: k.dryRun()})
+	metrics.ObserveKube("update", start, err)
+	return secret, err
+}
+
+func (k *kubeService) CreateSecret(ctx context.Context, secret *v1.Secret) (*v1.Secret, error) {
+	start := time.Now()
+	secret, err := k.clientSet.CoreV1().Secrets(secret.Namespace).Create(ctx, secret, metav1.CreateOptions{DryRun: k.dryRun()})
+	metrics.ObserveKube("create", start, err)
+	return secret, err
+}
@@ -0,0 +1,52 @@
+package k8s
+
+import (
+	"context"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"vault-injector/config"
+	"vault-injector/pkg/health"
+)
+
+func TestSecretListerWiring(t *testing.T) {
+	synced := map[string]string{"vault-injector/sync": "true"}
+	clientSet := fake.NewSimpleClientset(
+		&v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "app", Labels: synced}, Data: map[string][]byte{"password": []byte("one")}},
+		&v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "foreign"}},
+	)
+	factory, informer, lister := secretInformer(clientSet, "vault-injector")
+	k := &kubeService{Cfg: &config.Config{}, factory: factory, informer: informer, lister: lister, health: health.NewRegistry()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := k.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.checkWatch(); err != nil {
+		t.Errorf("watch unhealthy after sync: %v", err)
+	}
+
+	list, err := k.GetSecretList(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 1 || list.Items[0].Name != "app" {
+		t.Errorf("listed %+v, want only the labelled secret", list.Items)
+	}
+	secret, err := k.GetSecret(ctx, "dev", "app")
+	if err != nil || secret == nil {
+		t.Fatalf("dev/app = %v, %v", secret, err)
+	}
+	// callers get copies, the cache stays as it is
+	secret.Data["password"] = []byte("two")
+	list.Items[0].Data["password"] = []byte("two")
+	if cached, _ := k.GetSecret(ctx, "dev", "app"); string(cached.Data["password"]) != "one" { //nolint:errcheck
+		t.Error("informer cache modified through a returned secret")
+	}
+	for _, name := range []string{"foreign", "missing"} {
+		if secret, err := k.GetSecret(ctx, "dev", name); secret != nil || err != nil {
+			t.Errorf("dev/%s = %v, %v, want nil", name, secret, err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package k8s
+
+import (
+	"context"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"os"
+	"time"
+)
+
+// RunLeaderElection campaigns for the Lease and calls run with a context that
+// is cancelled when leadership is lost. It returns once ctx is done or
+// leadership is lost. Without LEADER_ELECTION run is called directly.
+func (k *kubeService) RunLeaderElection(ctx context.Context, run func(ctx context.Context)) {
+	le := k.Cfg.LeaderElection
+	if !le.Enabled {
+		run(ctx)
+		<-ctx.Done()
+		return
+	}
+	identity := le.Identity
+	if identity == "" {
+		identity, _ = os.Hostname() //nolint:errcheck
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: le.Namespace, Name: le.Name},
+		Client:     k.clientSet.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+	zap.S().Infof("leader election %s/%s as %s", le.Namespace, le.Name, identity)
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				zap.S().Infof("%s is the leader, starting controllers", identity)
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				zap.S().Warnf("%s is no longer the leader", identity)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					zap.S().Infof("current leader is %s", leader)
+				}
+			},
+		},
+	})
+}
@@ -0,0 +1,86 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"vault-injector/pkg/notify"
+)
+
+const (
+	PrunePolicyDelete = "delete"
+	PrunePolicyOrphan = "orphan"
+	PrunePolicyKeep   = "keep"
+)
+
+// PruneSecrets handles managed secrets which are gone from the map. Only
+// secrets owned by this instance are touched, and nothing is pruned when
+// more than PruneMaxPercent and more than PruneMinCount of them would go at
+// once, unless PruneForce is set.
+func (kr *kubeRepo) PruneSecrets(ctx context.Context, secrets []v1.Secret) {
+	var owned, prune []v1.Secret
+	for _, secret := range secrets {
+		if !kr.isOwned(&secret) {
+			if !kr.vault.IsNeedSecret(secret.Namespace + "/" + secret.Name) {
+				zap.S().Warnf("%s(%s) no in secretMap, owned by %q - SKIP prune", secret.Namespace, secret.Name,
+					secret.Annotations[kr.cfg.SecretLabel+"/owner"])
+			}
+			continue
+		}
+		owned = append(owned, secret)
+		if !kr.vault.IsNeedSecret(secret.Namespace + "/" + secret.Name) {
+			prune = append(prune, secret)
+		}
+	}
+	if len(prune) == 0 {
+		return
+	}
+	if kr.pruneRefused(len(prune), len(owned)) {
+		info := fmt.Sprintf("refuse to prune %d of %d secrets, more than %d%%. Check the secret map or set PRUNE_FORCE",
+			len(prune), len(owned), kr.cfg.PruneMaxPercent)
+		zap.S().Error(info)
+		kr.notifier.Notify(notify.Error, info)
+		return
+	}
+	for _, secret := range prune {
+		kr.pruneSecret(ctx, &secret)
+	}
+}
+
+// pruneRefused is the guard against a broken map wiping out secrets. Small
+// installs can always prune up to PruneMinCount secrets.
+func (kr *kubeRepo) pruneRefused(prune, owned int) bool {
+	if kr.cfg.PruneForce || prune <= kr.cfg.PruneMinCount {
+		return false
+	}
+	return prune*100 > kr.cfg.PruneMaxPercent*owned
+}
+
+func validPrunePolicy(policy string) bool {
+	return policy == PrunePolicyDelete || policy == PrunePolicyOrphan || policy == PrunePolicyKeep
+}
+
+func (kr *kubeRepo) isOwned(secret *v1.Secret) bool {
+	return secret.Annotations[kr.cfg.SecretLabel+"/owner"] == kr.cfg.InstanceName
+}
+
+func (kr *kubeRepo) pruneSecret(ctx context.Context, secret *v1.Secret) {
+	switch kr.cfg.PrunePolicy {
+	case PrunePolicyDelete:
+		zap.S().Infof("%s(%s) no in secretMap - DELETE", secret.Namespace, secret.Name)
+		kr.DeleteSecret(ctx, secret) //nolint:errcheck
+	case PrunePolicyOrphan:
+		zap.S().Infof("%s(%s) no in secretMap - ORPHAN", secret.Namespace, secret.Name)
+		orphan := secret.DeepCopy()
+		delete(orphan.Labels, kr.cfg.SecretLabel+"/sync")
+		for _, annotation := range []string{"/owner", "/map-source", "/checksum", "/source-versions"} {
+			delete(orphan.Annotations, kr.cfg.SecretLabel+annotation)
+		}
+		if err := kr.UpdateSecret(ctx, secret, orphan); err == nil {
+			kr.event(secret, v1.EventTypeNormal, ReasonOrphaned, "no longer in secret map, released by %s", kr.cfg.InstanceName)
+		}
+	case PrunePolicyKeep:
+		zap.S().Infof("%s(%s) no in secretMap - KEEP (prune policy %s)", secret.Namespace, secret.Name, kr.cfg.PrunePolicy)
+	}
+}
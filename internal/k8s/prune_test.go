@@ -0,0 +1,103 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"slices"
+	"testing"
+	"vault-injector/config"
+	"vault-injector/pkg/notify"
+)
+
+func ownedSecrets(cfg *config.Config, n int) []v1.Secret {
+	var secrets []v1.Secret
+	for i := 0; i < n; i++ {
+		secrets = append(secrets, v1.Secret{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "dev",
+			Name:        fmt.Sprintf("secret-%d", i),
+			Annotations: map[string]string{cfg.SecretLabel + "/owner": cfg.InstanceName},
+		}})
+	}
+	return secrets
+}
+
+func TestPruneRefused(t *testing.T) {
+	for _, tc := range []struct {
+		prune, owned int
+		force        bool
+		refused      bool
+	}{
+		{1, 1, false, false},
+		{3, 3, false, false},
+		{4, 10, false, true},
+		{3, 10, false, false},
+		{4, 20, false, false},
+		{10, 10, false, true},
+		{10, 10, true, false},
+	} {
+		cfg := testConfig()
+		cfg.PruneForce = tc.force
+		kr := &kubeRepo{cfg: cfg}
+		if got := kr.pruneRefused(tc.prune, tc.owned); got != tc.refused {
+			t.Errorf("prune %d of %d, force %t: refused %t, want %t", tc.prune, tc.owned, tc.force, got, tc.refused)
+		}
+	}
+}
+
+func TestPruneSecrets(t *testing.T) {
+	cfg := testConfig()
+	secrets := ownedSecrets(cfg, 10)
+	// secret-0 belongs to another instance, secret-1 predates the owner annotation
+	secrets[0].Annotations[cfg.SecretLabel+"/owner"] = "other"
+	delete(secrets[1].Annotations, cfg.SecretLabel+"/owner")
+	need := map[string]bool{}
+	for _, secret := range secrets[6:] {
+		need[secret.Namespace+"/"+secret.Name] = true
+	}
+
+	ks := &fakeKube{}
+	kr := &kubeRepo{cfg: cfg, ks: ks, vault: &fakeVault{secrets: need}, notifier: notify.Discard, written: make(map[string]string)}
+	kr.PruneSecrets(context.Background(), secrets)
+	if len(ks.deleted) != 0 {
+		t.Errorf("guard passed, deleted %v", ks.deleted)
+	}
+
+	cfg.PruneForce = true
+	kr.PruneSecrets(context.Background(), secrets)
+	if want := []string{"dev/secret-2", "dev/secret-3", "dev/secret-4", "dev/secret-5"}; !slices.Equal(ks.deleted, want) {
+		t.Errorf("deleted %v, want %v", ks.deleted, want)
+	}
+}
+
+func TestPruneOrphan(t *testing.T) {
+	cfg := testConfig()
+	cfg.PrunePolicy = PrunePolicyOrphan
+	secrets := ownedSecrets(cfg, 1)
+	secrets[0].Labels = map[string]string{cfg.SecretLabel + "/sync": "true"}
+	ks := &fakeKube{}
+	kr := &kubeRepo{cfg: cfg, ks: ks, vault: &fakeVault{}, notifier: notify.Discard, written: make(map[string]string)}
+	kr.PruneSecrets(context.Background(), secrets)
+	if len(ks.deleted) != 0 || len(ks.updated) != 1 {
+		t.Fatalf("deleted %v, %d updates", ks.deleted, len(ks.updated))
+	}
+	orphan := ks.updated[0]
+	if _, ok := orphan.Labels[cfg.SecretLabel+"/sync"]; ok {
+		t.Error("orphan keeps the sync label")
+	}
+	if kr.isOwned(orphan) {
+		t.Error("orphan keeps the owner annotation")
+	}
+}
+
+func TestValidPrunePolicy(t *testing.T) {
+	for _, policy := range []string{PrunePolicyDelete, PrunePolicyOrphan, PrunePolicyKeep} {
+		if !validPrunePolicy(policy) {
+			t.Errorf("%s rejected", policy)
+		}
+	}
+	if validPrunePolicy("remove") {
+		t.Error("unknown policy accepted")
+	}
+}
@@ -0,0 +1,159 @@
+package k8s
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"slices"
+	"strings"
+	"vault-injector/pkg/vault"
+)
+
+// rollout patches a checksum of the secret into the pod template of every
+// workload using it, so kubernetes rolls the pods. A workload uses a secret
+// when its pods reference it or when it names it in the
+// `<SecretLabel>/rollout-on` annotation (comma separated). Workloads whose
+// patch failed are remembered for healRollout.
+func (kr *kubeRepo) rollout(ctx context.Context, secret *v1.Secret) error {
+	return kr.patchWorkloads(ctx, secret, nil)
+}
+
+// healRollout retries the patches which failed on the last rollout of an
+// unchanged secret. A workload without an older checksum of the secret is
+// not rolled, it was created or replaced since and runs with the current
+// data. Without failed patches no workload is listed.
+func (kr *kubeRepo) healRollout(ctx context.Context, secret *v1.Secret, secretCfg vault.Secret) error {
+	if !secretCfg.Rollout {
+		return nil
+	}
+	kr.rolloutLock.Lock()
+	failed := kr.failedRollouts[secret.Namespace+"/"+secret.Name]
+	kr.rolloutLock.Unlock()
+	if len(failed) == 0 {
+		return nil
+	}
+	return kr.patchWorkloads(ctx, secret, failed)
+}
+
+// patchWorkloads rolls the workloads using the secret, only the ones in retry
+// when it is set. Workloads already carrying the checksum are left alone.
+func (kr *kubeRepo) patchWorkloads(ctx context.Context, secret *v1.Secret, retry map[string]bool) error {
+	workloads, err := kr.ks.ListWorkloads(ctx, secret.Namespace)
+	if err != nil {
+		zap.S().Errorf("%s(%s) rollout: %v", secret.Namespace, secret.Name, err)
+		return fmt.Errorf("rollout: %w", err)
+	}
+	key := kr.rolloutAnnotation(secret.Name)
+	value := secret.Annotations[kr.cfg.SecretLabel+"/checksum"]
+	failed := make(map[string]bool)
+	var errs []error
+	for _, workload := range workloads {
+		if !kr.usesSecret(workload, secret.Name) || workload.Template.Annotations[key] == value {
+			continue
+		}
+		id := workload.Kind + "/" + workload.Name
+		if retry != nil && (!retry[id] || workload.Template.Annotations[key] == "") {
+			continue
+		}
+		if kr.cfg.DryRun {
+			zap.S().Infow("dry-run",
+				"action", "rollout",
+				"namespace", workload.Namespace,
+				"name", workload.Name,
+				"kind", workload.Kind,
+				"secret", secret.Name,
+			)
+			if !kr.cfg.DryRunServer {
+				continue
+			}
+		}
+		patch, _ := json.Marshal(map[string]interface{}{ //nolint:errcheck
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"annotations": map[string]string{key: value},
+					},
+				},
+			},
+		})
+		if err := kr.ks.PatchWorkload(ctx, workload, patch); err != nil {
+			zap.S().Errorf("%s %s(%s) rollout: %v", workload.Kind, workload.Namespace, workload.Name, err)
+			kr.event(secret, v1.EventTypeWarning, ReasonSyncFailed, "%s %s rollout failed: %v", workload.Kind, workload.Name, err)
+			errs = append(errs, fmt.Errorf("rollout %s %s: %w", workload.Kind, workload.Name, err))
+			failed[id] = true
+			continue
+		}
+		zap.S().Infof("%s %s(%s) rollout for secret %s", workload.Kind, workload.Namespace, workload.Name, secret.Name)
+		kr.event(secret, v1.EventTypeNormal, ReasonRolledOut, "%s %s rolled out", workload.Kind, workload.Name)
+	}
+	kr.setFailedRollouts(secret.Namespace+"/"+secret.Name, failed)
+	return errors.Join(errs...)
+}
+
+func (kr *kubeRepo) setFailedRollouts(key string, failed map[string]bool) {
+	kr.rolloutLock.Lock()
+	defer kr.rolloutLock.Unlock()
+	if len(failed) == 0 {
+		delete(kr.failedRollouts, key)
+		return
+	}
+	if kr.failedRollouts == nil {
+		kr.failedRollouts = make(map[string]map[string]bool)
+	}
+	kr.failedRollouts[key] = failed
+}
+
+// rolloutAnnotation is the pod template annotation holding the checksum of
+// one secret. Names too long for an annotation key are hashed.
+func (kr *kubeRepo) rolloutAnnotation(name string) string {
+	if len(name) > 63-len("secret-") {
+		h := sha256.Sum256([]byte(name))
+		name = hex.EncodeToString(h[:])[:16]
+	}
+	return kr.cfg.SecretLabel + "/secret-" + name
+}
+
+func (kr *kubeRepo) usesSecret(workload Workload, name string) bool {
+	for _, n := range strings.Split(workload.Annotations[kr.cfg.SecretLabel+"/rollout-on"], ",") {
+		if strings.TrimSpace(n) == name {
+			return true
+		}
+	}
+	return slices.Contains(podSecrets(workload.Template.Spec), name)
+}
+
+// podSecrets lists the secrets a pod reads from volumes, env and envFrom.
+func podSecrets(spec v1.PodSpec) []string {
+	var names []string
+	for _, volume := range spec.Volumes {
+		if volume.Secret != nil {
+			names = append(names, volume.Secret.SecretName)
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.Secret != nil {
+					names = append(names, source.Secret.Name)
+				}
+			}
+		}
+	}
+	containers := append(slices.Clone(spec.InitContainers), spec.Containers...)
+	for _, container := range containers {
+		for _, env := range container.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+				names = append(names, env.ValueFrom.SecretKeyRef.Name)
+			}
+		}
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.SecretRef != nil {
+				names = append(names, envFrom.SecretRef.Name)
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,141 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"slices"
+	"testing"
+	"vault-injector/pkg/notify"
+	"vault-injector/pkg/vault"
+)
+
+func workloadUsing(name, secret string, annotations map[string]string) Workload {
+	return Workload{
+		Kind:      "Deployment",
+		Namespace: "dev",
+		Name:      name,
+		Template: v1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Annotations: annotations},
+			Spec: v1.PodSpec{Containers: []v1.Container{{
+				EnvFrom: []v1.EnvFromSource{{SecretRef: &v1.SecretEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: secret}}}},
+			}}},
+		},
+	}
+}
+
+// syncedSecret returns an owned secret in sync with secretCfg and versions.
+func syncedSecret(kr *kubeRepo, secretCfg vault.Secret, versions map[string]int) *v1.Secret {
+	secret := kr.NewSecret(secretCfg, map[string][]byte{"pass": []byte("secret")})
+	kr.applyMeta(secret, secretCfg)
+	kr.setSyncAnnotations(secret, secretCfg, versions)
+	return secret
+}
+
+func TestRolloutSkipsCurrentWorkloads(t *testing.T) {
+	cfg := testConfig()
+	ks := &fakeKube{}
+	kr := &kubeRepo{cfg: cfg, ks: ks, notifier: notify.Discard}
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "dev",
+		Name:        "app",
+		Annotations: map[string]string{cfg.SecretLabel + "/checksum": "new"},
+	}}
+	key := kr.rolloutAnnotation("app")
+	ks.workloads = []Workload{
+		workloadUsing("current", "app", map[string]string{key: "new"}),
+		workloadUsing("stale", "app", map[string]string{key: "old"}),
+		workloadUsing("missing", "app", nil),
+		workloadUsing("other", "db", nil),
+	}
+	if err := kr.rollout(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"stale", "missing"}; !slices.Equal(ks.patched, want) {
+		t.Errorf("patched %v, want %v", ks.patched, want)
+	}
+}
+
+func TestRolloutReturnsPatchErrors(t *testing.T) {
+	cfg := testConfig()
+	ks := &fakeKube{patchErr: errors.New("forbidden")}
+	kr := &kubeRepo{cfg: cfg, ks: ks, notifier: notify.Discard}
+	ks.workloads = []Workload{workloadUsing("web", "app", nil)}
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "dev",
+		Name:        "app",
+		Annotations: map[string]string{cfg.SecretLabel + "/checksum": "new"},
+	}}
+	if err := kr.rollout(context.Background(), secret); err == nil {
+		t.Error("failed patch not returned")
+	}
+}
+
+func TestUnchangedSecretHealsFailedRollout(t *testing.T) {
+	cfg := testConfig()
+	secretCfg := vault.Secret{Namespace: "dev", Name: "app", Type: v1.SecretTypeOpaque, Rollout: true}
+	versions := map[string]int{"projects/app": 3}
+	ks := &fakeKube{}
+	kr := &kubeRepo{cfg: cfg, ks: ks, notifier: notify.Discard, written: make(map[string]string),
+		vault: &fakeVault{cfgs: map[string]vault.Secret{"dev/app": secretCfg}, versions: versions}}
+	secret := syncedSecret(kr, secretCfg, versions)
+	key := kr.rolloutAnnotation("app")
+	ks.workloads = []Workload{
+		workloadUsing("web", "app", map[string]string{key: "old"}),
+		workloadUsing("worker", "app", map[string]string{key: "old"}),
+	}
+
+	// nothing failed, an unchanged pass lists no workloads
+	if err := kr.CompareSecret(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if ks.listed != 0 || len(ks.patched) != 0 {
+		t.Fatalf("%d lists, patched %v without a failed rollout", ks.listed, ks.patched)
+	}
+
+	// the rollout of the new checksum fails for both
+	ks.patchErr = errors.New("forbidden")
+	if err := kr.rollout(context.Background(), secret); err == nil {
+		t.Fatal("failed patch not returned")
+	}
+	// worker was replaced since, it runs with the current data
+	ks.workloads[1] = workloadUsing("worker", "app", nil)
+	ks.workloads = append(ks.workloads, workloadUsing("fresh", "app", nil))
+	ks.patchErr = nil
+	if err := kr.CompareSecret(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if len(ks.updated) != 0 {
+		t.Errorf("unchanged secret written")
+	}
+	if want := []string{"web"}; !slices.Equal(ks.patched, want) {
+		t.Errorf("patched %v, want %v", ks.patched, want)
+	}
+
+	// healed, the next pass lists nothing
+	ks.listed = 0
+	if err := kr.CompareSecret(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if ks.listed != 0 {
+		t.Errorf("%d lists after the rollout healed", ks.listed)
+	}
+}
+
+func TestHealRolloutReturnsErrors(t *testing.T) {
+	cfg := testConfig()
+	secretCfg := vault.Secret{Namespace: "dev", Name: "app", Rollout: true}
+	ks := &fakeKube{patchErr: errors.New("forbidden")}
+	kr := &kubeRepo{cfg: cfg, ks: ks, notifier: notify.Discard}
+	ks.workloads = []Workload{workloadUsing("web", "app", map[string]string{kr.rolloutAnnotation("app"): "old"})}
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "dev",
+		Name:        "app",
+		Annotations: map[string]string{cfg.SecretLabel + "/checksum": "new"},
+	}}
+	kr.rollout(context.Background(), secret) //nolint:errcheck
+	if err := kr.healRollout(context.Background(), secret, secretCfg); err == nil {
+		t.Error("failed retry not returned")
+	}
+}
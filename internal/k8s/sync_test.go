@@ -0,0 +1,131 @@
+package k8s
+
+import (
+	"context"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"testing"
+	"vault-injector/pkg/notify"
+	"vault-injector/pkg/vault"
+)
+
+func newSyncRepo(versions map[string]int, data map[string][]byte) (*kubeRepo, *fakeKube, *fakeVault) {
+	secretCfg := vault.Secret{Namespace: "dev", Name: "app", Type: v1.SecretTypeOpaque}
+	ks := &fakeKube{}
+	fv := &fakeVault{cfgs: map[string]vault.Secret{"dev/app": secretCfg}, versions: versions, data: data}
+	kr := &kubeRepo{cfg: testConfig(), ks: ks, vault: fv, notifier: notify.Discard, written: make(map[string]string)}
+	return kr, ks, fv
+}
+
+func TestCompareSecretSkipsUnchangedVersions(t *testing.T) {
+	versions := map[string]int{"projects/dev/db": 3}
+	kr, ks, fv := newSyncRepo(versions, map[string][]byte{"pass": []byte("secret")})
+	secret := syncedSecret(kr, fv.cfgs["dev/app"], versions)
+	if err := kr.CompareSecret(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if fv.reads != 0 || len(ks.updated) != 0 {
+		t.Errorf("%d vault reads, %d updates for an unchanged secret", fv.reads, len(ks.updated))
+	}
+}
+
+func TestCompareSecretReadsChangedVersion(t *testing.T) {
+	kr, ks, fv := newSyncRepo(map[string]int{"projects/dev/db": 3}, map[string][]byte{"pass": []byte("secret")})
+	secret := syncedSecret(kr, fv.cfgs["dev/app"], fv.versions)
+	fv.versions = map[string]int{"projects/dev/db": 4}
+	fv.data = map[string][]byte{"pass": []byte("rotated")}
+	if err := kr.CompareSecret(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if fv.reads != 1 || len(ks.updated) != 1 {
+		t.Fatalf("%d vault reads, %d updates, want one each", fv.reads, len(ks.updated))
+	}
+	updated := ks.updated[0]
+	if string(updated.Data["pass"]) != "rotated" {
+		t.Errorf("data %q", updated.Data)
+	}
+	if got := updated.Annotations[kr.cfg.SecretLabel+"/source-versions"]; got != `{"projects/dev/db":4}` {
+		t.Errorf("source versions %s", got)
+	}
+	// the next pass finds it in sync
+	fv.reads = 0
+	if err := kr.CompareSecret(context.Background(), updated); err != nil {
+		t.Fatal(err)
+	}
+	if fv.reads != 0 {
+		t.Error("updated secret read again")
+	}
+}
+
+func TestCompareSecretEditedSecret(t *testing.T) {
+	versions := map[string]int{"projects/dev/db": 3}
+	kr, ks, fv := newSyncRepo(versions, map[string][]byte{"pass": []byte("secret")})
+	secret := syncedSecret(kr, fv.cfgs["dev/app"], versions)
+	secret.Data["pass"] = []byte("edited by hand")
+	if err := kr.CompareSecret(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if len(ks.updated) != 1 || string(ks.updated[0].Data["pass"]) != "secret" {
+		t.Errorf("edited secret not restored: %d updates", len(ks.updated))
+	}
+}
+
+func TestCompareSecretOwnedByOtherInstance(t *testing.T) {
+	versions := map[string]int{"projects/dev/db": 3}
+	kr, ks, fv := newSyncRepo(versions, map[string][]byte{"pass": []byte("rotated")})
+	secret := syncedSecret(kr, fv.cfgs["dev/app"], versions)
+	secret.Annotations[kr.cfg.SecretLabel+"/owner"] = "other-injector"
+	fv.versions = map[string]int{"projects/dev/db": 4}
+	if err := kr.CompareSecret(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if fv.reads != 0 || len(ks.updated) != 0 {
+		t.Errorf("secret of another instance synced: %d reads, %d updates", fv.reads, len(ks.updated))
+	}
+	if events := ks.GetRecorder().(*record.FakeRecorder).Events; len(events) != 1 {
+		t.Errorf("%d events, want an owner conflict", len(events))
+	}
+}
+
+func TestCompareSecretAdoptsLegacySecret(t *testing.T) {
+	versions := map[string]int{"projects/dev/db": 3}
+	kr, ks, fv := newSyncRepo(versions, map[string][]byte{"pass": []byte("secret")})
+	secret := syncedSecret(kr, fv.cfgs["dev/app"], versions)
+	delete(secret.Annotations, kr.cfg.SecretLabel+"/owner")
+	if err := kr.CompareSecret(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if len(ks.updated) != 1 || !kr.isOwned(ks.updated[0]) {
+		t.Errorf("legacy secret not adopted: %d updates", len(ks.updated))
+	}
+}
+
+func TestIsOwnWrite(t *testing.T) {
+	kr, _, _ := newSyncRepo(nil, nil)
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "app", ResourceVersion: "7",
+		Annotations: map[string]string{"vault-injector/checksum": "abc"}}}
+	if err := kr.UpdateSecret(context.Background(), secret, secret); err != nil {
+		t.Fatal(err)
+	}
+	if !kr.IsOwnWrite(secret) {
+		t.Error("own write not recognized")
+	}
+	edited := secret.DeepCopy()
+	edited.ResourceVersion = "8"
+	if kr.IsOwnWrite(edited) {
+		t.Error("write of someone else taken as own")
+	}
+	// the mismatch forgets the write, an event with the old version is stale
+	if kr.IsOwnWrite(secret) {
+		t.Error("write still remembered after a newer version was seen")
+	}
+
+	empty := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "new", ResourceVersion: "1"}}
+	if err := kr.UpdateSecret(context.Background(), empty, empty); err != nil {
+		t.Fatal(err)
+	}
+	if kr.IsOwnWrite(empty) {
+		t.Error("empty secret remembered, its event has to fill it")
+	}
+}
@@ -0,0 +1,72 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"time"
+	"vault-injector/pkg/metrics"
+)
+
+// Workload is a Deployment, StatefulSet or DaemonSet reduced to what a
+// rollout needs.
+type Workload struct {
+	Kind        string
+	Namespace   string
+	Name        string
+	Annotations map[string]string
+	Template    v1.PodTemplateSpec
+}
+
+// ListWorkloads reads the workloads of a namespace straight from the API,
+// rollouts are rare enough to not need an informer.
+func (k *kubeService) ListWorkloads(ctx context.Context, namespace string) (workloads []Workload, err error) {
+	start := time.Now()
+	defer func() {
+		metrics.ObserveKube("list_workloads", start, err)
+	}()
+	apps := k.clientSet.AppsV1()
+	deployments, err := apps.Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list deployments: %w", err)
+	}
+	for _, d := range deployments.Items {
+		workloads = append(workloads, Workload{"Deployment", d.Namespace, d.Name, d.Annotations, d.Spec.Template})
+	}
+	statefulSets, err := apps.StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list statefulsets: %w", err)
+	}
+	for _, s := range statefulSets.Items {
+		workloads = append(workloads, Workload{"StatefulSet", s.Namespace, s.Name, s.Annotations, s.Spec.Template})
+	}
+	daemonSets, err := apps.DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list daemonsets: %w", err)
+	}
+	for _, d := range daemonSets.Items {
+		workloads = append(workloads, Workload{"DaemonSet", d.Namespace, d.Name, d.Annotations, d.Spec.Template})
+	}
+	return workloads, nil
+}
+
+func (k *kubeService) PatchWorkload(ctx context.Context, workload Workload, patch []byte) error {
+	apps := k.clientSet.AppsV1()
+	opt := metav1.PatchOptions{DryRun: k.dryRun()}
+	start := time.Now()
+	var err error
+	switch workload.Kind {
+	case "Deployment":
+		_, err = apps.Deployments(workload.Namespace).Patch(ctx, workload.Name, types.StrategicMergePatchType, patch, opt)
+	case "StatefulSet":
+		_, err = apps.StatefulSets(workload.Namespace).Patch(ctx, workload.Name, types.StrategicMergePatchType, patch, opt)
+	case "DaemonSet":
+		_, err = apps.DaemonSets(workload.Namespace).Patch(ctx, workload.Name, types.StrategicMergePatchType, patch, opt)
+	default:
+		err = fmt.Errorf("unknown workload kind %s", workload.Kind)
+	}
+	metrics.ObserveKube("patch_workload", start, err)
+	return err
+}
@@ -0,0 +1,85 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+type Kind int
+
+const (
+	Readiness Kind = 1 << iota
+	Liveness
+)
+
+type Status struct {
+	Healthy bool   `json:"healthy"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+type check struct {
+	kind Kind
+	fn   func() error
+}
+
+// Registry collects the health checks of the components. A component is only
+// checked after it registered, so parts which are not running (controllers
+// on a non-leader replica) don't fail the probes.
+type Registry struct {
+	checks map[string]check
+	sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{checks: make(map[string]check)}
+}
+
+// Register adds or replaces the check of a component. fn returns nil while
+// the component is healthy.
+func (r *Registry) Register(name string, kind Kind, fn func() error) {
+	r.Lock()
+	defer r.Unlock()
+	r.checks[name] = check{kind: kind, fn: fn}
+}
+
+// Check runs every check of the kind.
+func (r *Registry) Check(kind Kind) (bool, map[string]Status) {
+	r.Lock()
+	checks := make(map[string]check, len(r.checks))
+	for name, c := range r.checks {
+		if c.kind&kind != 0 {
+			checks[name] = c
+		}
+	}
+	r.Unlock()
+	healthy := true
+	components := make(map[string]Status, len(checks))
+	for name, c := range checks {
+		if err := c.fn(); err != nil {
+			healthy = false
+			components[name] = Status{Detail: err.Error()}
+		} else {
+			components[name] = Status{Healthy: true}
+		}
+	}
+	return healthy, components
+}
+
+// Handler answers with the JSON status of every component of the kind, 503
+// when one of them fails.
+func (r *Registry) Handler(kind Kind) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		healthy, components := r.Check(kind)
+		status := "ok"
+		w.Header().Set("Content-Type", "application/json")
+		if !healthy {
+			status = "fail"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+			"status":     status,
+			"components": components,
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckByKind(t *testing.T) {
+	r := NewRegistry()
+	r.Register("vault", Readiness|Liveness, func() error { return nil })
+	r.Register("reconcile", Readiness, func() error { return errors.New("first reconcile not finished") })
+
+	healthy, components := r.Check(Readiness)
+	if healthy || len(components) != 2 {
+		t.Errorf("readiness healthy %t, components %v", healthy, components)
+	}
+	if status := components["reconcile"]; status.Healthy || status.Detail == "" {
+		t.Errorf("reconcile = %+v", status)
+	}
+	healthy, components = r.Check(Liveness)
+	if !healthy || len(components) != 1 {
+		t.Errorf("liveness healthy %t, components %v", healthy, components)
+	}
+}
+
+func TestRegisterReplaces(t *testing.T) {
+	r := NewRegistry()
+	r.Register("loop", Liveness, func() error { return errors.New("stale") })
+	r.Register("loop", Liveness, func() error { return nil })
+	if healthy, _ := r.Check(Liveness); !healthy {
+		t.Error("old check still runs")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	// nothing registered, e.g. a follower
+	rec := httptest.NewRecorder()
+	r.Handler(Readiness)(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("empty registry answers %d", rec.Code)
+	}
+
+	r.Register("reconcile", Readiness, func() error { return errors.New("first reconcile not finished") })
+	rec = httptest.NewRecorder()
+	r.Handler(Readiness)(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("failing check answers %d", rec.Code)
+	}
+	var body struct {
+		Status     string            `json:"status"`
+		Components map[string]Status `json:"components"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Status != "fail" || body.Components["reconcile"].Detail != "first reconcile not finished" {
+		t.Errorf("body = %+v", body)
+	}
+}
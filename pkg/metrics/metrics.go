@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+const namespace = "vault_injector"
+
+var (
+	ManagedSecrets = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "managed_secrets",
+		Help:      "Number of secrets labelled for sync.",
+	})
+	MapSecrets = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "map_secrets",
+		Help:      "Number of secrets in the loaded secret map.",
+	})
+	Syncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "syncs_total",
+		Help:      "Secret syncs by result (success, error, dropped).",
+	}, []string{"result"})
+	SyncDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Duration of one secret sync.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	LastSyncSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_sync_success_timestamp_seconds",
+		Help:      "Time of the last successful secret sync.",
+	})
+	LastReconcile = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_reconcile_timestamp_seconds",
+		Help:      "Time of the last full reconcile pass synced without errors.",
+	})
+	QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Secrets waiting in the work queue.",
+	})
+	VaultRequests = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "vault_request_duration_seconds",
+		Help:      "Vault request latency by operation and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+	VaultCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "vault_cache_hits_total",
+		Help:      "Vault reads served from the per-pass read cache.",
+	})
+	KubeRequests = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "kube_request_duration_seconds",
+		Help:      "Kubernetes API request latency by verb and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"verb", "result"})
+	WatchRestarts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watch_restarts_total",
+		Help:      "Secret watch failures after which the informer relists.",
+	})
+	WatchEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watch_events_total",
+		Help:      "Secret watch events by type (add, update, own_write).",
+	}, []string{"type"})
+)
+
+// ObserveVault records a vault request started at start.
+func ObserveVault(operation string, start time.Time, err error) {
+	VaultRequests.WithLabelValues(operation, result(err)).Observe(time.Since(start).Seconds())
+}
+
+// ObserveKube records a kubernetes API request started at start.
+func ObserveKube(verb string, start time.Time, err error) {
+	KubeRequests.WithLabelValues(verb, result(err)).Observe(time.Since(start).Seconds())
+}
+
+// RegisterTokenTTL exports the remaining vault token TTL read from ttl.
+func RegisterTokenTTL(ttl func() time.Duration) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "vault_token_ttl_seconds",
+		Help:      "Remaining TTL of the vault token, 0 for tokens without expiry.",
+	}, func() float64 {
+		return ttl().Seconds()
+	})
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
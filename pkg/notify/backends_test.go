@@ -0,0 +1,162 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capture answers with status and keeps the last request and its JSON body.
+func capture(t *testing.T, status int) (*httptest.Server, *http.Request, map[string]interface{}) {
+	t.Helper()
+	var req http.Request
+	body := map[string]interface{}{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = *r
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &req, body
+}
+
+func TestSlack(t *testing.T) {
+	srv, req, body := capture(t, http.StatusOK)
+	if err := NewSlack(srv.URL).Send(context.Background(), Message{Text: "vault down"}); err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("%s with content type %q", req.Method, req.Header.Get("Content-Type"))
+	}
+	if body["text"] != "vault down" {
+		t.Errorf("body = %v", body)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	srv, req, body := capture(t, http.StatusAccepted)
+	msg := Message{Severity: Warning, Text: "vault down", Instance: "vault-injector", Time: time.Now(), Suppressed: 3}
+	if err := NewWebhook(srv.URL, "s3cret").Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer s3cret" {
+		t.Errorf("authorization %q", got)
+	}
+	if body["severity"] != "warning" || body["text"] != "vault down" || body["instance"] != "vault-injector" || body["suppressed"] != 3.0 {
+		t.Errorf("body = %v", body)
+	}
+}
+
+func TestWebhookWithoutToken(t *testing.T) {
+	srv, req, _ := capture(t, http.StatusOK)
+	if err := NewWebhook(srv.URL, "").Send(context.Background(), Message{Text: "vault down"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Authorization"); got != "" {
+		t.Errorf("authorization %q without a token", got)
+	}
+}
+
+func TestPostJSONStatus(t *testing.T) {
+	srv, _, _ := capture(t, http.StatusInternalServerError)
+	if err := NewSlack(srv.URL).Send(context.Background(), Message{Text: "vault down"}); err == nil {
+		t.Error("500 not reported")
+	}
+}
+
+// smtpStandIn accepts one mail and hands its envelope and data to mails.
+func smtpStandIn(t *testing.T) (string, chan []string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	mails := make(chan []string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) } //nolint:errcheck
+		var lines []string
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "MAIL", "RCPT":
+				lines = append(lines, line)
+				reply("250 OK")
+			case "DATA":
+				reply("354 go ahead")
+				for {
+					data, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if data == ".\r\n" {
+						break
+					}
+					lines = append(lines, strings.TrimRight(data, "\r\n"))
+				}
+				reply("250 OK")
+			case "QUIT":
+				reply("221 bye")
+				mails <- lines
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+	return l.Addr().String(), mails
+}
+
+func TestSMTP(t *testing.T) {
+	addr, mails := smtpStandIn(t)
+	smtp := NewSMTP(addr, "vault-injector@localhost", []string{" ops@example.com", "", "dev@example.com "}, "", "")
+	msg := Message{Severity: Error, Text: "vault down\nsince 5m", Instance: "vault-injector"}
+	if err := smtp.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	select {
+	case lines = <-mails:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail received")
+	}
+	mail := strings.Join(lines, "\n")
+	for _, want := range []string{
+		"MAIL FROM:<vault-injector@localhost>",
+		"RCPT TO:<ops@example.com>",
+		"RCPT TO:<dev@example.com>",
+		"Subject: [vault-injector] error",
+		"vault down\nsince 5m",
+	} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("mail has no %q:\n%s", want, mail)
+		}
+	}
+}
+
+func TestSMTPWithoutRecipients(t *testing.T) {
+	if err := NewSMTP("127.0.0.1:25", "vault-injector@localhost", []string{""}, "", "").Send(context.Background(), Message{}); err == nil {
+		t.Error("sent without recipients")
+	}
+}
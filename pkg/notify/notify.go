@@ -0,0 +1,201 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"vault-injector/config"
+)
+
+type Severity int
+
+const (
+	Info Severity = iota
+	Warning
+	Error
+	// off disables a backend
+	off
+)
+
+var severities = map[string]Severity{
+	"info":    Info,
+	"warning": Warning,
+	"error":   Error,
+	"off":     off,
+}
+
+func (s Severity) String() string {
+	for name, severity := range severities {
+		if severity == s {
+			return name
+		}
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+// Message is what a backend sends. Text is already rendered with the
+// template of the backend.
+type Message struct {
+	Severity   Severity
+	Text       string
+	Instance   string
+	Time       time.Time
+	Suppressed int
+}
+
+// Sender delivers a message to one backend.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// enabler is a Sender which may be routed before it is configured, telegram
+// gets its token from vault after start. It is skipped while not enabled.
+type enabler interface {
+	Enabled() bool
+}
+
+// Notifier routes alerts to every backend whose minimum severity they reach.
+// The same alert is sent once per dedup window.
+type Notifier interface {
+	Notify(severity Severity, text string)
+}
+
+// Discard drops every alert, for one-shot commands.
+var Discard Notifier = discard{}
+
+type discard struct{}
+
+func (discard) Notify(Severity, string) {}
+
+const sendTimeout = 10 * time.Second
+
+const defaultTemplate = `{{.Text}}{{if .Suppressed}} ({{.Suppressed}} more suppressed){{end}}`
+
+type route struct {
+	name     string
+	sender   Sender
+	severity Severity
+	template *template.Template
+}
+
+type notifier struct {
+	cfg        *config.Config
+	routes     []route
+	sent       map[string]time.Time
+	suppressed map[string]int
+	sync.Mutex
+}
+
+// New builds the notifier from config. Telegram is routed unless
+// TELEGRAM_SEVERITY=off, but only sends once it has a token from
+// TELEGRAM_TOKEN or vault. The other backends are routed once their target
+// is set.
+func New(cfg *config.Config, telegram Sender) Notifier {
+	n := &notifier{
+		cfg:        cfg,
+		sent:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+	n.addRoute("telegram", telegram, cfg.Telegram.Severity, cfg.Telegram.Template)
+	if cfg.Slack.WebhookURL != "" {
+		n.addRoute("slack", NewSlack(string(cfg.Slack.WebhookURL)), cfg.Slack.Severity, cfg.Slack.Template)
+	}
+	if cfg.Webhook.URL != "" {
+		n.addRoute("webhook", NewWebhook(cfg.Webhook.URL, string(cfg.Webhook.Token)), cfg.Webhook.Severity, cfg.Webhook.Template)
+	}
+	if cfg.SMTP.Addr != "" {
+		smtp := NewSMTP(cfg.SMTP.Addr, cfg.SMTP.From, strings.Split(cfg.SMTP.To, ","), cfg.SMTP.Username, string(cfg.SMTP.Password))
+		n.addRoute("smtp", smtp, cfg.SMTP.Severity, cfg.SMTP.Template)
+	}
+	return n
+}
+
+func (n *notifier) addRoute(name string, sender Sender, severity, text string) {
+	s, ok := severities[strings.ToLower(severity)]
+	if !ok {
+		zap.S().Errorf("notify %s: unknown severity %q, using error", name, severity)
+		s = Error
+	}
+	if s == off {
+		return
+	}
+	if text == "" {
+		text = n.cfg.Notify.Template
+	}
+	if text == "" {
+		text = defaultTemplate
+	}
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		zap.S().Errorf("notify %s: template: %v, using default", name, err)
+		tmpl = template.Must(template.New(name).Parse(defaultTemplate))
+	}
+	n.routes = append(n.routes, route{name: name, sender: sender, severity: s, template: tmpl})
+	zap.S().Infof("notify %s from severity %s", name, s)
+}
+
+// Notify sends in the background, alerts must never block a sync.
+func (n *notifier) Notify(severity Severity, text string) {
+	suppressed, ok := n.dedup(severity, text)
+	if !ok {
+		return
+	}
+	msg := Message{
+		Severity:   severity,
+		Text:       text,
+		Instance:   n.cfg.InstanceName,
+		Time:       time.Now(),
+		Suppressed: suppressed,
+	}
+	for _, r := range n.routes {
+		if severity < r.severity {
+			continue
+		}
+		if e, ok := r.sender.(enabler); ok && !e.Enabled() {
+			continue
+		}
+		go n.send(r, msg)
+	}
+}
+
+func (n *notifier) send(r route, msg Message) {
+	var text bytes.Buffer
+	if err := r.template.Execute(&text, msg); err != nil {
+		zap.S().Errorf("notify %s: template: %v", r.name, err)
+		return
+	}
+	msg.Text = text.String()
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	if err := r.sender.Send(ctx, msg); err != nil {
+		zap.S().Errorf("notify %s: %v", r.name, err)
+	}
+}
+
+// dedup reports whether the alert is due and how many copies were
+// suppressed since it was last sent.
+func (n *notifier) dedup(severity Severity, text string) (int, bool) {
+	window := time.Duration(n.cfg.Notify.Dedup) * time.Second
+	key := severity.String() + "\n" + text
+	n.Lock()
+	defer n.Unlock()
+	now := time.Now()
+	for k, sent := range n.sent {
+		if now.Sub(sent) >= window {
+			delete(n.sent, k)
+		}
+	}
+	if _, ok := n.sent[key]; ok {
+		n.suppressed[key]++
+		return 0, false
+	}
+	n.sent[key] = now
+	suppressed := n.suppressed[key]
+	delete(n.suppressed, key)
+	return suppressed, true
+}
@@ -0,0 +1,157 @@
+package notify
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+	"vault-injector/config"
+)
+
+// fakeSender hands every message to sent, Notify sends in the background.
+type fakeSender struct {
+	sent    chan Message
+	enabled bool
+}
+
+func newFakeSender() *fakeSender {
+	return &fakeSender{sent: make(chan Message, 10), enabled: true}
+}
+
+func (f *fakeSender) Send(ctx context.Context, msg Message) error {
+	f.sent <- msg
+	return nil
+}
+
+func (f *fakeSender) Enabled() bool {
+	return f.enabled
+}
+
+func newTestNotifier() *notifier {
+	return &notifier{
+		cfg:        &config.Config{InstanceName: "vault-injector"},
+		sent:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+}
+
+func received(t *testing.T, f *fakeSender) (Message, bool) {
+	t.Helper()
+	select {
+	case msg := <-f.sent:
+		return msg, true
+	case <-time.After(200 * time.Millisecond):
+		return Message{}, false
+	}
+}
+
+func TestSeverityRouting(t *testing.T) {
+	n := newTestNotifier()
+	senders := map[string]*fakeSender{}
+	for _, severity := range []string{"info", "warning", "error", "off"} {
+		senders[severity] = newFakeSender()
+		n.addRoute(severity, senders[severity], severity, "")
+	}
+	if len(n.routes) != 3 {
+		t.Fatalf("%d routes, want off left out", len(n.routes))
+	}
+	n.Notify(Warning, "token renewal failed")
+	for severity, want := range map[string]bool{"info": true, "warning": true, "error": false, "off": false} {
+		if _, got := received(t, senders[severity]); got != want {
+			t.Errorf("%s route received %t, want %t", severity, got, want)
+		}
+	}
+}
+
+func TestUnknownSeverityFallsBackToError(t *testing.T) {
+	n := newTestNotifier()
+	n.addRoute("slack", newFakeSender(), "critical", "")
+	if n.routes[0].severity != Error {
+		t.Errorf("severity %s, want error", n.routes[0].severity)
+	}
+}
+
+func TestDisabledSenderSkipped(t *testing.T) {
+	n := newTestNotifier()
+	telegram := newFakeSender()
+	telegram.enabled = false
+	n.addRoute("telegram", telegram, "info", "")
+	n.Notify(Error, "vault login failed")
+	if _, ok := received(t, telegram); ok {
+		t.Error("sent without a token")
+	}
+	telegram.enabled = true
+	n.Notify(Error, "vault login failed again")
+	if _, ok := received(t, telegram); !ok {
+		t.Error("not sent once enabled")
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	n := newTestNotifier()
+	n.cfg.Notify.Template = "[{{.Instance}}] {{.Text}}"
+	custom, global, broken := newFakeSender(), newFakeSender(), newFakeSender()
+	n.addRoute("custom", custom, "info", "{{.Severity}}: {{.Text}}")
+	n.addRoute("global", global, "info", "")
+	n.addRoute("broken", broken, "info", "{{.Text")
+	n.Notify(Error, "sync failed")
+	for _, tc := range []struct {
+		sender *fakeSender
+		want   string
+	}{
+		{custom, "error: sync failed"},
+		{global, "[vault-injector] sync failed"},
+		{broken, "sync failed"},
+	} {
+		msg, ok := received(t, tc.sender)
+		if !ok || msg.Text != tc.want {
+			t.Errorf("text %q, want %q", msg.Text, tc.want)
+		}
+	}
+}
+
+func TestDedup(t *testing.T) {
+	n := newTestNotifier()
+	n.cfg.Notify.Dedup = 60
+	if _, ok := n.dedup(Error, "vault down"); !ok {
+		t.Fatal("first alert suppressed")
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := n.dedup(Error, "vault down"); ok {
+			t.Fatal("repeated alert sent within the window")
+		}
+	}
+	if _, ok := n.dedup(Warning, "vault down"); !ok {
+		t.Error("same text with another severity suppressed")
+	}
+
+	// the window passed
+	n.sent[Error.String()+"\nvault down"] = time.Now().Add(-time.Minute)
+	suppressed, ok := n.dedup(Error, "vault down")
+	if !ok || suppressed != 2 {
+		t.Errorf("sent %t with %d suppressed, want 2", ok, suppressed)
+	}
+}
+
+func TestSuppressedInDefaultTemplate(t *testing.T) {
+	n := newTestNotifier()
+	n.cfg.Notify.Dedup = 60
+	sender := newFakeSender()
+	n.addRoute("slack", sender, "info", "")
+	n.Notify(Error, "vault down")
+	n.Notify(Error, "vault down")
+	n.sent[Error.String()+"\nvault down"] = time.Now().Add(-time.Minute)
+	n.Notify(Error, "vault down")
+	// sends run in the background, in any order
+	var texts []string
+	for i := 0; i < 2; i++ {
+		msg, _ := received(t, sender)
+		texts = append(texts, msg.Text)
+	}
+	if !slices.Contains(texts, "vault down") || !slices.Contains(texts, "vault down (1 more suppressed)") {
+		t.Errorf("texts %q", texts)
+	}
+	if _, ok := received(t, sender); ok {
+		t.Error("suppressed alert sent")
+	}
+}
@@ -0,0 +1,20 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+)
+
+// Slack posts to a slack incoming webhook.
+type Slack struct {
+	url    string
+	client *http.Client
+}
+
+func NewSlack(url string) *Slack {
+	return &Slack{url: url, client: http.DefaultClient}
+}
+
+func (s *Slack) Send(ctx context.Context, msg Message) error {
+	return postJSON(ctx, s.client, s.url, "", map[string]string{"text": msg.Text})
+}
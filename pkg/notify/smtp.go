@@ -0,0 +1,55 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// SMTP mails every message. Auth is used when a username is set, net/smtp
+// only sends it over TLS or to localhost.
+type SMTP struct {
+	addr     string
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+func NewSMTP(addr, from string, to []string, username, password string) *SMTP {
+	var recipients []string
+	for _, r := range to {
+		if r = strings.TrimSpace(r); r != "" {
+			recipients = append(recipients, r)
+		}
+	}
+	return &SMTP{addr: addr, from: from, to: recipients, username: username, password: password}
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	if len(s.to) == 0 {
+		return fmt.Errorf("no recipients")
+	}
+	var auth smtp.Auth
+	if s.username != "" {
+		host, _, err := net.SplitHostPort(s.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.username, s.password, host)
+	}
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: [%s] %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		s.from, strings.Join(s.to, ", "), msg.Instance, msg.Severity, strings.ReplaceAll(msg.Text, "\n", "\r\n"))
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.addr, auth, s.from, s.to, []byte(body))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,66 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Webhook posts every message as JSON to a generic endpoint, with an
+// optional bearer token.
+type Webhook struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+type webhookBody struct {
+	Severity   string    `json:"severity"`
+	Text       string    `json:"text"`
+	Instance   string    `json:"instance"`
+	Time       time.Time `json:"time"`
+	Suppressed int       `json:"suppressed,omitempty"`
+}
+
+func NewWebhook(url, token string) *Webhook {
+	return &Webhook{url: url, token: token, client: http.DefaultClient}
+}
+
+func (w *Webhook) Send(ctx context.Context, msg Message) error {
+	return postJSON(ctx, w.client, w.url, w.token, webhookBody{
+		Severity:   msg.Severity.String(),
+		Text:       msg.Text,
+		Instance:   msg.Instance,
+		Time:       msg.Time,
+		Suppressed: msg.Suppressed,
+	})
+}
+
+func postJSON(ctx context.Context, client *http.Client, url, token string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()        //nolint:errcheck
+	io.Copy(io.Discard, response.Body) //nolint:errcheck
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %q", response.Status)
+	}
+	return nil
+}
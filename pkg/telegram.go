@@ -2,12 +2,18 @@ package telegram
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
 	"vault-injector/config"
+	"vault-injector/pkg/notify"
 )
 
 type Message struct {
@@ -18,29 +24,59 @@ type Message struct {
 type Telegram struct {
 	ChatID int64 `json:"chat_id"`
 	Token  config.Password
+	URL    string
+	sync.RWMutex
 }
 
 func NewTelegram(config *config.Config) *Telegram {
 	return &Telegram{
 		ChatID: config.Telegram.Channel,
 		Token:  config.Telegram.Token,
+		URL:    strings.TrimSuffix(config.Telegram.URL, "/"),
 	}
 }
-func (t *Telegram) SendMessage(str string) error {
-	msg := &Message{
-		ChatID: t.ChatID,
-		Text:   fmt.Sprintf("%s", str),
-	}
 
-	payload, err := json.Marshal(msg)
+// SetCredentials replaces the chat and token read from vault.
+func (t *Telegram) SetCredentials(chatID int64, token config.Password) {
+	t.Lock()
+	defer t.Unlock()
+	t.ChatID = chatID
+	t.Token = token
+}
+
+// Enabled reports whether a token is set, without one nothing is sent.
+func (t *Telegram) Enabled() bool {
+	t.RLock()
+	defer t.RUnlock()
+	return t.Token != ""
+}
+
+func (t *Telegram) Send(ctx context.Context, msg notify.Message) error {
+	t.RLock()
+	chatID, token := t.ChatID, t.Token
+	t.RUnlock()
+	payload, err := json.Marshal(&Message{
+		ChatID: chatID,
+		Text:   msg.Text,
+	})
 	if err != nil {
 		return err
 	}
-	url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", t.Token)
-	response, err := http.Post(url, "application/json", bytes.NewBuffer(payload))
+	url := fmt.Sprintf("%s/bot%s/sendMessage", t.URL, token)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(payload))
 	if err != nil {
 		return err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// the url holds the token, keep it out of the logs
+		var urlErr *neturl.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("send message: %w", err)
+	}
 	defer func(body io.ReadCloser) {
 		if err := body.Close(); err != nil {
 			log.Println("failed to close response body")
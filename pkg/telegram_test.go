@@ -0,0 +1,71 @@
+package telegram
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"vault-injector/config"
+	"vault-injector/pkg/notify"
+)
+
+func newTestTelegram(t *testing.T, token config.Password, handler http.HandlerFunc) *Telegram {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	cfg := &config.Config{}
+	cfg.Telegram.URL = srv.URL + "/"
+	cfg.Telegram.Channel = 42
+	cfg.Telegram.Token = token
+	return NewTelegram(cfg)
+}
+
+func TestSend(t *testing.T) {
+	var path string
+	var got Message
+	tg := newTestTelegram(t, "123:abc", func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&got) //nolint:errcheck
+	})
+	if err := tg.Send(context.Background(), notify.Message{Text: "vault down"}); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/bot123:abc/sendMessage" {
+		t.Errorf("path %q", path)
+	}
+	if got.ChatID != 42 || got.Text != "vault down" {
+		t.Errorf("message = %+v", got)
+	}
+}
+
+func TestSendStatus(t *testing.T) {
+	tg := newTestTelegram(t, "123:abc", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	if err := tg.Send(context.Background(), notify.Message{Text: "vault down"}); err == nil {
+		t.Error("401 not reported")
+	}
+}
+
+func TestSendErrorHidesToken(t *testing.T) {
+	tg := newTestTelegram(t, "123:abc", nil)
+	tg.URL = "http://127.0.0.1:1"
+	err := tg.Send(context.Background(), notify.Message{Text: "vault down"})
+	if err == nil || strings.Contains(err.Error(), "123:abc") {
+		t.Errorf("error %v", err)
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	tg := newTestTelegram(t, "", nil)
+	if tg.Enabled() {
+		t.Error("enabled without a token")
+	}
+	// the token read from vault
+	tg.SetCredentials(7, "123:abc")
+	if !tg.Enabled() {
+		t.Error("not enabled with the token from vault")
+	}
+}
@@ -0,0 +1,129 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/api/auth/approle"
+	auth "github.com/hashicorp/vault/api/auth/kubernetes"
+	"github.com/hashicorp/vault/api/auth/userpass"
+	"os"
+	"strings"
+	"time"
+	"vault-injector/config"
+)
+
+// newAuthMethod builds the vault auth method selected by VAULT_AUTH_METHOD.
+// It is called on every login, so credentials from files are re-read.
+func newAuthMethod(cfg *config.Config) (vault.AuthMethod, error) {
+	a := cfg.VaultAuth
+	switch a.Method {
+	case "", "kubernetes":
+		opts := []auth.LoginOption{auth.WithServiceAccountTokenPath(cfg.TokenPath)}
+		if a.Mount != "" {
+			opts = append(opts, auth.WithMountPath(a.Mount))
+		}
+		return auth.NewKubernetesAuth(cfg.VaultRole, opts...)
+	case "approle":
+		var opts []approle.LoginOption
+		if a.Mount != "" {
+			opts = append(opts, approle.WithMountPath(a.Mount))
+		}
+		return approle.NewAppRoleAuth(a.RoleID, &approle.SecretID{
+			FromFile:   a.SecretIDFile,
+			FromString: string(a.SecretID),
+		}, opts...)
+	case "userpass":
+		var opts []userpass.LoginOption
+		if a.Mount != "" {
+			opts = append(opts, userpass.WithMountPath(a.Mount))
+		}
+		return userpass.NewUserpassAuth(a.Username, &userpass.Password{
+			FromFile:   a.PasswordFile,
+			FromString: string(a.Password),
+		}, opts...)
+	case "jwt", "oidc":
+		mount := a.Mount
+		if mount == "" {
+			mount = a.Method
+		}
+		jwt, err := readCredential(string(a.JWT), a.JWTFile)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: %w", err)
+		}
+		return &jwtAuth{mount: mount, role: cfg.VaultRole, jwt: jwt}, nil
+	case "token":
+		token, err := readCredential(string(a.Token), a.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("token: %w", err)
+		}
+		return &tokenAuth{token: token}, nil
+	}
+	return nil, fmt.Errorf("unknown vault auth method %q", a.Method)
+}
+
+func readCredential(value, file string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+	if file == "" {
+		return "", errors.New("neither value nor file is set")
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// jwtAuth logs in with a JWT/OIDC token through the jwt auth backend.
+type jwtAuth struct {
+	mount string
+	role  string
+	jwt   string
+}
+
+func (a *jwtAuth) Login(ctx context.Context, client *vault.Client) (*vault.Secret, error) {
+	return client.Logical().WriteWithContext(ctx, "auth/"+a.mount+"/login", map[string]interface{}{
+		"role": a.role,
+		"jwt":  a.jwt,
+	})
+}
+
+// tokenAuth uses a static token. Login only looks the token up, so the
+// lease duration is known for the re-login ticker. A token without an
+// expire time has no ttl, one whose ttl ran down to zero has expired.
+type tokenAuth struct {
+	token string
+}
+
+func (a *tokenAuth) Login(ctx context.Context, client *vault.Client) (*vault.Secret, error) {
+	client.SetToken(a.token)
+	secret, err := client.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := secret.TokenTTL()
+	if err != nil {
+		return nil, err
+	}
+	if ttl < time.Second && secret.Data["expire_time"] != nil {
+		return nil, errors.New("token expired")
+	}
+	renewable, err := secret.TokenIsRenewable()
+	if err != nil {
+		return nil, err
+	}
+	accessor, _ := secret.TokenAccessor() //nolint:errcheck
+	policies, _ := secret.TokenPolicies() //nolint:errcheck
+	return &vault.Secret{
+		Auth: &vault.SecretAuth{
+			ClientToken:   a.token,
+			Accessor:      accessor,
+			Policies:      policies,
+			LeaseDuration: int(ttl.Seconds()),
+			Renewable:     renewable,
+		},
+	}, nil
+}
@@ -0,0 +1,117 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hashicorp/vault/api/auth/approle"
+	auth "github.com/hashicorp/vault/api/auth/kubernetes"
+	"github.com/hashicorp/vault/api/auth/userpass"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"vault-injector/config"
+)
+
+func TestNewAuthMethod(t *testing.T) {
+	// the service account token for kubernetes, the vault token for token
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("s.file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		method string
+		set    func(cfg *config.Config)
+		want   interface{}
+	}{
+		{"", nil, &auth.KubernetesAuth{}},
+		{"kubernetes", nil, &auth.KubernetesAuth{}},
+		{"approle", func(cfg *config.Config) { cfg.VaultAuth.RoleID, cfg.VaultAuth.SecretID = "role", "secret" }, &approle.AppRoleAuth{}},
+		{"userpass", func(cfg *config.Config) { cfg.VaultAuth.Username, cfg.VaultAuth.Password = "user", "pass" }, &userpass.UserpassAuth{}},
+		{"jwt", func(cfg *config.Config) { cfg.VaultAuth.JWT = "jwt" }, &jwtAuth{mount: "jwt", role: "app", jwt: "jwt"}},
+		{"oidc", func(cfg *config.Config) { cfg.VaultAuth.JWT = "jwt" }, &jwtAuth{mount: "oidc", role: "app", jwt: "jwt"}},
+		{"token", func(cfg *config.Config) { cfg.VaultAuth.TokenFile = tokenFile }, &tokenAuth{token: "s.file"}},
+	} {
+		cfg := &config.Config{VaultRole: "app", TokenPath: tokenFile}
+		cfg.VaultAuth.Method = tc.method
+		if tc.set != nil {
+			tc.set(cfg)
+		}
+		method, err := newAuthMethod(cfg)
+		if err != nil {
+			t.Errorf("%q: %v", tc.method, err)
+			continue
+		}
+		if reflect.TypeOf(method) != reflect.TypeOf(tc.want) {
+			t.Errorf("%q: got %T, want %T", tc.method, method, tc.want)
+			continue
+		}
+		switch want := tc.want.(type) {
+		case *jwtAuth, *tokenAuth:
+			if !reflect.DeepEqual(method, want) {
+				t.Errorf("%q: got %+v, want %+v", tc.method, method, want)
+			}
+		}
+	}
+}
+
+func TestNewAuthMethodErrors(t *testing.T) {
+	for _, method := range []string{"ldap", "jwt", "token"} {
+		cfg := &config.Config{}
+		cfg.VaultAuth.Method = method
+		if _, err := newAuthMethod(cfg); err == nil {
+			t.Errorf("%q accepted without credentials", method)
+		}
+	}
+}
+
+func TestJWTAuthLogin(t *testing.T) {
+	var path string
+	var body map[string]interface{}
+	v := newTestService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)             //nolint:errcheck
+		json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+			"auth": map[string]interface{}{"client_token": "s.jwt", "lease_duration": 300},
+		})
+	}))
+	secret, err := (&jwtAuth{mount: "oidc", role: "app", jwt: "header.payload.sig"}).Login(context.Background(), v.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/v1/auth/oidc/login" || body["role"] != "app" || body["jwt"] != "header.payload.sig" {
+		t.Errorf("login at %s with %v", path, body)
+	}
+	if secret.Auth.ClientToken != "s.jwt" || secret.Auth.LeaseDuration != 300 {
+		t.Errorf("auth %+v", secret.Auth)
+	}
+}
+
+func TestTokenAuthLogin(t *testing.T) {
+	var token string
+	v := newTestService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("X-Vault-Token")
+		json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+			"data": map[string]interface{}{
+				"ttl":         120,
+				"expire_time": "2030-01-01T00:00:00Z",
+				"renewable":   true,
+				"accessor":    "acc",
+				"policies":    []string{"default", "injector"},
+			},
+		})
+	}))
+	secret, err := (&tokenAuth{token: "s.static"}).Login(context.Background(), v.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "s.static" {
+		t.Errorf("looked up with token %q", token)
+	}
+	a := secret.Auth
+	if a.ClientToken != "s.static" || a.Accessor != "acc" || a.LeaseDuration != 120 || !a.Renewable ||
+		!reflect.DeepEqual(a.Policies, []string{"default", "injector"}) {
+		t.Errorf("auth %+v", a)
+	}
+}
@@ -0,0 +1,143 @@
+package vault
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"sync"
+	"vault-injector/pkg/metrics"
+)
+
+type cacheCtxKey struct{}
+
+// readCache keeps Vault KV reads for a single reconcile pass, so each
+// mount/path is fetched only once no matter how many keys reference it.
+// Workers asking for a path already being read wait for that read.
+type readCache struct {
+	entries map[string]*kvEntry
+	hits    int
+	misses  int
+	sync.Mutex
+}
+
+// kvEntry is one path of the cache. version belongs to data once data is
+// read, before it is the current version from the metadata endpoint.
+// reading is set for a data read and closed when it is done, the fields are
+// not changed after that.
+type kvEntry struct {
+	data    map[string]interface{}
+	version int
+	err     error
+	reading chan struct{}
+}
+
+// WithReadCache returns a context carrying a fresh read cache. Every
+// GetData/GetDockerData call made with this context shares it.
+func WithReadCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheCtxKey{}, &readCache{entries: make(map[string]*kvEntry)})
+}
+
+// EnsureReadCache returns ctx when it carries a read cache, else a context
+// with a fresh one. Versions read after the data with it are the versions of
+// that data.
+func EnsureReadCache(ctx context.Context) context.Context {
+	if getReadCache(ctx) != nil {
+		return ctx
+	}
+	return WithReadCache(ctx)
+}
+
+// LogReadCache writes the hit/miss counters of the context cache to the log.
+func LogReadCache(ctx context.Context) {
+	c := getReadCache(ctx)
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	paths := 0
+	for _, entry := range c.entries {
+		if entry.data != nil {
+			paths++
+		}
+	}
+	zap.S().Infof("vault read cache: paths %d, hits %d, misses %d", paths, c.hits, c.misses)
+}
+
+func getReadCache(ctx context.Context) *readCache {
+	c, _ := ctx.Value(cacheCtxKey{}).(*readCache)
+	return c
+}
+
+// fetch returns the data of key, calling read only when no read of key is
+// done or in flight. A failed read is handed to the callers waiting for it,
+// the next caller reads again.
+func (c *readCache) fetch(ctx context.Context, key string, read func() (map[string]interface{}, int, error)) (map[string]interface{}, error) {
+	if c == nil {
+		data, _, err := read()
+		return data, err
+	}
+	c.Lock()
+	if entry, ok := c.entries[key]; ok && entry.reading != nil {
+		c.hits++
+		metrics.VaultCacheHits.Inc()
+		c.Unlock()
+		select {
+		case <-entry.reading:
+			return entry.data, entry.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c.misses++
+	entry := &kvEntry{reading: make(chan struct{})}
+	c.entries[key] = entry
+	c.Unlock()
+
+	data, version, err := read()
+	c.Lock()
+	entry.data, entry.version, entry.err = data, version, err
+	if err != nil {
+		delete(c.entries, key)
+	}
+	close(entry.reading)
+	c.Unlock()
+	return data, err
+}
+
+// getVersion returns the version known for key, waiting for a data read in
+// flight.
+func (c *readCache) getVersion(ctx context.Context, key string) (int, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.Lock()
+	entry, ok := c.entries[key]
+	c.Unlock()
+	if !ok {
+		return 0, false
+	}
+	if entry.reading != nil {
+		select {
+		case <-entry.reading:
+		case <-ctx.Done():
+			return 0, false
+		}
+		if entry.err != nil {
+			return 0, false
+		}
+	}
+	return entry.version, true
+}
+
+// setVersion stores the current version of a path not read yet. Data read
+// later replaces it with the version of that data.
+func (c *readCache) setVersion(key string, version int) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = &kvEntry{version: version}
+	}
+}
@@ -0,0 +1,215 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// kv2Vault serves a KV v2 mount "projects". write stores a new version.
+type kv2Vault struct {
+	data     map[string]map[string]interface{}
+	versions map[string]int
+	reads    map[string]int
+	sync.Mutex
+}
+
+func newKV2Vault() *kv2Vault {
+	return &kv2Vault{data: make(map[string]map[string]interface{}), versions: make(map[string]int), reads: make(map[string]int)}
+}
+
+func (f *kv2Vault) write(path string, data map[string]interface{}) {
+	f.Lock()
+	defer f.Unlock()
+	f.data[path] = data
+	f.versions[path]++
+}
+
+func (f *kv2Vault) readsOf(path string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.reads[path]
+}
+
+func (f *kv2Vault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/projects/data/"), "/v1/projects/metadata/")
+	if f.data[path] == nil {
+		http.NotFound(w, r)
+		return
+	}
+	var body interface{}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/projects/data/"):
+		f.reads[path]++
+		body = map[string]interface{}{
+			"data": f.data[path],
+			"metadata": map[string]interface{}{
+				"version":       f.versions[path],
+				"created_time":  "2024-01-01T00:00:00Z",
+				"deletion_time": "",
+			},
+		}
+	default:
+		body = map[string]interface{}{
+			"current_version": f.versions[path],
+			"created_time":    "2024-01-01T00:00:00Z",
+			"updated_time":    "2024-01-01T00:00:00Z",
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": body}) //nolint:errcheck
+}
+
+func newKV2Service(t *testing.T) (*vaultService, *kv2Vault) {
+	t.Helper()
+	f := newKV2Vault()
+	v := newTestService(t, f)
+	v.mounts["projects"] = mountInfo{Type: "kv", KVVersion: 2}
+	secretMap, err := ParseMapData([]byte("dev/app:\n  - password:projects/dev/db:password\ndev/worker:\n  - password:projects/dev/db:password\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.secretMap = secretMap
+	return v, f
+}
+
+func TestVersionOfCachedData(t *testing.T) {
+	v, f := newKV2Service(t)
+	f.write("dev/db", map[string]interface{}{"password": "one"})
+	ctx := WithReadCache(context.Background())
+	if _, err := v.GetData(ctx, "dev", "app"); err != nil {
+		t.Fatal(err)
+	}
+	// written in vault after the pass read the path
+	f.write("dev/db", map[string]interface{}{"password": "two"})
+
+	versions, err := v.GetVersions(ctx, "dev", "worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions["projects/dev/db"] != 1 {
+		t.Errorf("version %d paired with the data of version 1", versions["projects/dev/db"])
+	}
+	versions, err = v.GetVersions(WithReadCache(context.Background()), "dev", "worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions["projects/dev/db"] != 2 {
+		t.Errorf("current version %d, want 2 from metadata", versions["projects/dev/db"])
+	}
+}
+
+func TestMetadataVersionReplacedByData(t *testing.T) {
+	v, f := newKV2Service(t)
+	f.write("dev/db", map[string]interface{}{"password": "one"})
+	ctx := WithReadCache(context.Background())
+	if _, err := v.GetVersions(ctx, "dev", "app"); err != nil {
+		t.Fatal(err)
+	}
+	f.write("dev/db", map[string]interface{}{"password": "two"})
+	data, err := v.GetData(ctx, "dev", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, _ := v.GetVersions(ctx, "dev", "app") //nolint:errcheck
+	if string(data["password"]) != "two" || versions["projects/dev/db"] != 2 {
+		t.Errorf("data %q with version %d", data["password"], versions["projects/dev/db"])
+	}
+}
+
+func TestEnsureReadCache(t *testing.T) {
+	ctx := WithReadCache(context.Background())
+	if getReadCache(EnsureReadCache(ctx)) != getReadCache(ctx) {
+		t.Error("cache of the pass replaced")
+	}
+	if getReadCache(EnsureReadCache(context.Background())) == nil {
+		t.Error("no cache added")
+	}
+}
+
+func TestReadCacheWaitsForReadInFlight(t *testing.T) {
+	c := getReadCache(WithReadCache(context.Background()))
+	release := make(chan struct{})
+	var reads atomic.Int32
+	read := func() (map[string]interface{}, int, error) {
+		reads.Add(1)
+		<-release
+		return map[string]interface{}{"password": "one"}, 3, nil
+	}
+	var wg sync.WaitGroup
+	results := make(chan map[string]interface{}, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := c.fetch(context.Background(), "projects/dev/db", read)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- data
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+	if n := reads.Load(); n != 1 {
+		t.Errorf("%d reads by 4 workers, want 1", n)
+	}
+	for data := range results {
+		if data["password"] != "one" {
+			t.Errorf("data %v", data)
+		}
+	}
+	if version, ok := c.getVersion(context.Background(), "projects/dev/db"); !ok || version != 3 {
+		t.Errorf("version %d, %t, want the one of the data", version, ok)
+	}
+}
+
+func TestReadCacheRetriesFailedRead(t *testing.T) {
+	c := getReadCache(WithReadCache(context.Background()))
+	if _, err := c.fetch(context.Background(), "projects/dev/db", func() (map[string]interface{}, int, error) {
+		return nil, 0, errors.New("permission denied")
+	}); err == nil {
+		t.Fatal("error lost")
+	}
+	data, err := c.fetch(context.Background(), "projects/dev/db", func() (map[string]interface{}, int, error) {
+		return map[string]interface{}{"password": "one"}, 1, nil
+	})
+	if err != nil || data["password"] != "one" {
+		t.Errorf("data %v, %v, want a new read after the failed one", data, err)
+	}
+}
+func TestReadCacheSharesPaths(t *testing.T) {
+	v, f := newKV2Service(t)
+	f.write("dev/db", map[string]interface{}{"password": "one"})
+	ctx := WithReadCache(context.Background())
+	for _, name := range []string{"app", "worker"} {
+		data, err := v.GetData(ctx, "dev", name)
+		if err != nil || string(data["password"]) != "one" {
+			t.Fatalf("%s: %q, %v", name, data, err)
+		}
+	}
+	if reads := f.readsOf("dev/db"); reads != 1 {
+		t.Errorf("%d reads of dev/db in one pass, want 1", reads)
+	}
+	c := getReadCache(ctx)
+	if c.hits != 1 || c.misses != 1 {
+		t.Errorf("hits %d, misses %d, want 1 each", c.hits, c.misses)
+	}
+
+	// the next pass reads again
+	if _, err := v.GetData(WithReadCache(context.Background()), "dev", "app"); err != nil {
+		t.Fatal(err)
+	}
+	if reads := f.readsOf("dev/db"); reads != 2 {
+		t.Errorf("%d reads of dev/db after two passes, want 2", reads)
+	}
+}
@@ -0,0 +1,181 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	vault "github.com/hashicorp/vault/api"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+	"vault-injector/pkg/metrics"
+)
+
+// lease is a dynamic secret (database/creds/<role> and alike) held for one
+// kubernetes secret. The same credentials are returned on every reconcile
+// until vault refuses to renew the lease.
+type lease struct {
+	owner     string
+	namespace string
+	secret    *vault.Secret
+	watcher   *vault.LifetimeWatcher
+	expired   bool
+}
+
+type leaseStore struct {
+	items map[string]*lease
+	sync.Mutex
+}
+
+func leaseKey(owner, mount, path string) string {
+	return owner + "|" + mount + "/" + path
+}
+
+// readDynamic returns the data of the lease held by the secret from ctx,
+// requesting new credentials only when there is no live lease. The read runs
+// without the store lock, a slow read must not hold up other secrets.
+func (v *vaultService) readDynamic(ctx context.Context, mount, path string) (map[string]interface{}, error) {
+	owner := ctx.Value("secret").(string)
+	key := leaseKey(owner, mount, path)
+	if l := v.liveLease(key); l != nil {
+		return l.secret.Data, nil
+	}
+	if isReadOnly(ctx) {
+		return nil, errReadOnly
+	}
+	client := v.clientFor(ctx)
+	start := time.Now()
+	secret, err := client.Logical().ReadWithContext(ctx, mount+"/"+path)
+	metrics.ObserveVault("dynamic_read", start, err)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("%s/%s: no secret returned", mount, path)
+	}
+	l := &lease{owner: owner, namespace: getNamespace(ctx), secret: secret}
+	v.leases.Lock()
+	if current, ok := v.leases.items[key]; ok && !current.expired {
+		// a concurrent read won, keep its credentials and drop ours
+		v.leases.Unlock()
+		v.revokeLease(l)
+		return current.secret.Data, nil
+	}
+	v.leases.items[key] = l
+	v.leases.Unlock()
+	zap.S().Infof("%s lease %s acquired, duration: %d, renewable: %t", owner, secret.LeaseID, secret.LeaseDuration, secret.Renewable)
+	if secret.LeaseID == "" {
+		return secret.Data, nil
+	}
+	watcher, err := client.NewLifetimeWatcher(&vault.LifetimeWatcherInput{Secret: secret})
+	if err != nil {
+		zap.S().Errorf("%s lease %s watcher: %v", owner, secret.LeaseID, err)
+		return secret.Data, nil
+	}
+	v.leases.Lock()
+	l.watcher = watcher
+	v.leases.Unlock()
+	go watcher.Start()
+	go v.watchLease(key, l, watcher)
+	return secret.Data, nil
+}
+
+func (v *vaultService) liveLease(key string) *lease {
+	v.leases.Lock()
+	defer v.leases.Unlock()
+	if l, ok := v.leases.items[key]; ok && !l.expired {
+		return l
+	}
+	return nil
+}
+
+// watchLease waits until the lease can't be renewed any more, then marks it
+// expired and forces an update so new credentials reach kubernetes.
+func (v *vaultService) watchLease(key string, l *lease, watcher *vault.LifetimeWatcher) {
+	defer watcher.Stop()
+	for {
+		select {
+		case <-v.ctx.Done():
+			return
+		case renewal := <-watcher.RenewCh():
+			zap.S().Debugf("lease %s renewed, duration: %d", l.secret.LeaseID, renewal.Secret.LeaseDuration)
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				zap.S().Errorf("lease %s renew failed: %v", l.secret.LeaseID, err)
+			}
+			v.leases.Lock()
+			current, ok := v.leases.items[key]
+			if ok && current == l {
+				l.expired = true
+			}
+			v.leases.Unlock()
+			if !ok || current != l {
+				return
+			}
+			zap.S().Infof("lease %s expired, rotate credentials", l.secret.LeaseID)
+			v.forceUpdate()
+			return
+		}
+	}
+}
+
+// releaseLeases revokes leases held for secrets which are gone from the map.
+func (v *vaultService) releaseLeases(secretMap SecretMap) {
+	owners := make(map[string]bool)
+	for _, secret := range secretMap {
+		owners[secretID(secret.Namespace, secret.Name)] = true
+	}
+	var released []*lease
+	v.leases.Lock()
+	for key, l := range v.leases.items {
+		if owners[l.owner] {
+			continue
+		}
+		delete(v.leases.items, key)
+		if l.watcher != nil {
+			l.watcher.Stop()
+		}
+		released = append(released, l)
+	}
+	v.leases.Unlock()
+	for _, l := range released {
+		v.revokeLease(l)
+	}
+}
+
+// expireLeases drops every lease after a re-login with a new token. Leases
+// are children of the token they were issued to, so the next reconcile has
+// to request new credentials with the new one. The dropped leases are not
+// revoked but left to expire with the old token: workloads keep using them
+// until the rotated secrets are rolled out. Nothing changes when the login
+// returned the old token.
+func (v *vaultService) expireLeases(oldToken, newToken string) {
+	if oldToken == newToken {
+		return
+	}
+	v.leases.Lock()
+	n := len(v.leases.items)
+	for key, l := range v.leases.items {
+		delete(v.leases.items, key)
+		if l.watcher != nil {
+			l.watcher.Stop()
+		}
+	}
+	v.leases.Unlock()
+	if n == 0 {
+		return
+	}
+	zap.S().Infof("vault token replaced, rotate credentials of %d leases", n)
+	v.forceUpdate()
+}
+
+func (v *vaultService) revokeLease(l *lease) {
+	if l.secret.LeaseID == "" {
+		return
+	}
+	ctx := withNamespace(v.ctx, l.namespace)
+	if err := v.clientFor(ctx).Sys().RevokeWithContext(ctx, l.secret.LeaseID); err != nil {
+		zap.S().Errorf("lease %s revoke: %v", l.secret.LeaseID, err)
+	} else {
+		zap.S().Infof("lease %s revoked", l.secret.LeaseID)
+	}
+}
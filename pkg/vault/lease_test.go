@@ -0,0 +1,159 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	vault "github.com/hashicorp/vault/api"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"vault-injector/config"
+	"vault-injector/pkg/notify"
+)
+
+// fakeVault serves dynamic credentials and records lease revocations.
+type fakeVault struct {
+	reads   int
+	revoked []string
+	sync.Mutex
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/database/creds/app":
+		f.reads++
+		json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+			"lease_id":       fmt.Sprintf("database/creds/app/%d", f.reads),
+			"lease_duration": 3600,
+			"renewable":      false,
+			"data":           map[string]interface{}{"username": fmt.Sprintf("user-%d", f.reads)},
+		})
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/sys/leases/revoke":
+		var body struct {
+			LeaseID string `json:"lease_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&body) //nolint:errcheck
+		f.revoked = append(f.revoked, body.LeaseID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestService(t *testing.T, handler http.Handler) *vaultService {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	vaultConfig := vault.DefaultConfig()
+	vaultConfig.Address = srv.URL
+	client, err := vault.NewClient(vaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken("test")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &vaultService{
+		cfg:         &config.Config{PKIRenewPercent: 66},
+		notifier:    notify.Discard,
+		client:      client,
+		mounts:      make(map[string]mountInfo),
+		updateChan:  make(chan config.UpdateInterface, 1),
+		leases:      leaseStore{items: make(map[string]*lease)},
+		renewTimers: make(map[string]*time.Timer),
+		ctx:         ctx,
+	}
+}
+
+func readUser(t *testing.T, v *vaultService, owner string) string {
+	t.Helper()
+	ctx := context.WithValue(context.Background(), "secret", owner)
+	data, err := v.readDynamic(ctx, "database", "creds/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data["username"].(string)
+}
+
+func TestReadDynamicKeepsLease(t *testing.T) {
+	fake := &fakeVault{}
+	v := newTestService(t, fake)
+	first := readUser(t, v, "app(default)")
+	if second := readUser(t, v, "app(default)"); second != first {
+		t.Errorf("credentials changed from %s to %s with a live lease", first, second)
+	}
+	if other := readUser(t, v, "other(default)"); other == first {
+		t.Errorf("secrets share the lease %s", first)
+	}
+	if fake.reads != 2 {
+		t.Errorf("vault reads = %d, want 2", fake.reads)
+	}
+}
+
+func TestReleaseLeasesRevokesRemovedSecrets(t *testing.T) {
+	fake := &fakeVault{}
+	v := newTestService(t, fake)
+	readUser(t, v, "app(default)")
+	readUser(t, v, "other(default)")
+	v.releaseLeases(SecretMap{"default/app": {Namespace: "default", Name: "app"}})
+	if len(fake.revoked) != 1 || fake.revoked[0] != "database/creds/app/2" {
+		t.Errorf("revoked = %v, want the lease of other(default)", fake.revoked)
+	}
+	if len(v.leases.items) != 1 {
+		t.Errorf("%d leases left, want 1", len(v.leases.items))
+	}
+}
+
+func TestExpireLeasesRotatesCredentials(t *testing.T) {
+	fake := &fakeVault{}
+	v := newTestService(t, fake)
+	first := readUser(t, v, "app(default)")
+	v.expireLeases("old", "new")
+	select {
+	case <-v.updateChan:
+	default:
+		t.Error("no update after the leases expired")
+	}
+	if second := readUser(t, v, "app(default)"); second == first {
+		t.Errorf("credentials %s kept after re-login", first)
+	}
+	// left to expire with the old token, nothing to revoke
+	if len(fake.revoked) != 0 {
+		t.Errorf("revoked = %v, want none", fake.revoked)
+	}
+}
+
+func TestExpireLeasesKeepsLeasesOfSameToken(t *testing.T) {
+	fake := &fakeVault{}
+	v := newTestService(t, fake)
+	first := readUser(t, v, "app(default)")
+	v.expireLeases("test", "test")
+	if len(v.updateChan) != 0 {
+		t.Error("credentials rotated without a new token")
+	}
+	if second := readUser(t, v, "app(default)"); second != first {
+		t.Errorf("credentials %s replaced by %s", first, second)
+	}
+}
+
+func TestReadOnlyTakesNoLease(t *testing.T) {
+	fake := &fakeVault{}
+	v := newTestService(t, fake)
+	v.mounts["database"] = mountInfo{Type: "database"}
+	ctx := context.WithValue(WithReadOnly(context.Background()), "secret", "app(default)")
+	value, err := v.GetVaultSecret(ctx, "database", "creds/app", "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "<lease of database/creds/app>" {
+		t.Errorf("value = %q, want a placeholder", value)
+	}
+	if fake.reads != 0 || len(v.leases.items) != 0 {
+		t.Errorf("read only: %d reads, %d leases", fake.reads, len(v.leases.items))
+	}
+}
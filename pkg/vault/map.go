@@ -1,42 +1,375 @@
 package vault
 
 import (
-	"go.uber.org/zap"
+	"fmt"
 	"gopkg.in/yaml.v3"
+	v1 "k8s.io/api/core/v1"
 	"os"
+	"path"
 	"strings"
 )
 
-type _SecretMap map[string][]string
+// PKI describes a certificate issued by a vault pki `issue/<role>` endpoint.
+type PKI struct {
+	Issue      string   `yaml:"pki" json:"pki"`
+	CommonName string   `yaml:"common_name" json:"common_name"`
+	AltNames   []string `yaml:"alt_names" json:"alt_names,omitempty"`
+	IPSans     []string `yaml:"ip_sans" json:"ip_sans,omitempty"`
+	TTL        string   `yaml:"ttl" json:"ttl,omitempty"`
+}
+
+// From copies every key of a vault path, `*:mount/path` in the short form.
+type From struct {
+	Path    string   `yaml:"from" json:"from"`
+	Prefix  string   `yaml:"prefix" json:"prefix,omitempty"`
+	Include []string `yaml:"include" json:"include,omitempty"`
+	Exclude []string `yaml:"exclude" json:"exclude,omitempty"`
+}
+
+// _Item is a mapping item of a secret: a pki certificate, a whole vault path
+// or secret wide options.
+type _Item struct {
+	PKI            `yaml:",inline"`
+	From           `yaml:",inline"`
+	VaultNamespace string `yaml:"vault_namespace"`
+	Rollout        bool   `yaml:"rollout"`
+}
+
+// _SecretMapV2 is the structured map format, selected by `version: 2`.
+type _SecretMapV2 struct {
+	Version int         `yaml:"version"`
+	Secrets []yaml.Node `yaml:"secrets"`
+}
+
+type _SecretV2 struct {
+	Namespace      string            `yaml:"namespace"`
+	Name           string            `yaml:"name"`
+	Type           string            `yaml:"type"`
+	Labels         map[string]string `yaml:"labels"`
+	Annotations    map[string]string `yaml:"annotations"`
+	Immutable      bool              `yaml:"immutable"`
+	VaultNamespace string            `yaml:"vault_namespace"`
+	Rollout        bool              `yaml:"rollout"`
+	Data           []yaml.Node       `yaml:"data"`
+}
 
 type Secret struct {
-	Namespace string
-	Name      string
-	ValuePath []string
+	Namespace      string
+	Name           string
+	Type           v1.SecretType
+	Labels         map[string]string `json:",omitempty"`
+	Annotations    map[string]string `json:",omitempty"`
+	Immutable      bool              `json:",omitempty"`
+	VaultNamespace string            `json:",omitempty"`
+	Rollout        bool              `json:",omitempty"`
+	ValuePath      []string
+	From           []From `json:",omitempty"`
+	PKI            *PKI   `json:",omitempty"`
 }
 
 type SecretMap map[string]Secret
 
-func ParseMap(file string) SecretMap {
-	zap.S().Debug(file)
+var secretTypes = map[string]v1.SecretType{
+	"opaque":           v1.SecretTypeOpaque,
+	"dockerconfigjson": v1.SecretTypeDockerConfigJson,
+	"tls":              v1.SecretTypeTLS,
+	"basic-auth":       v1.SecretTypeBasicAuth,
+	"ssh-auth":         v1.SecretTypeSSHAuth,
+}
+
+// ParseMap loads the secret map. A file with `version: 2` on top is read as
+// the structured format, anything else as the flat v1 format
+// `namespace/name: [key:mount/path:vaultkey]`. Every problem found is
+// returned with its line number, a map with errors must not be used.
+func ParseMap(file string) (SecretMap, error) {
 	yamlFile, err := os.ReadFile(file)
 	if err != nil {
-		zap.S().Errorf("yamlFile.Get err   #%v ", err)
+		return nil, fmt.Errorf("read secret map: %w", err)
 	}
-	var _secretMap _SecretMap
-	err = yaml.Unmarshal(yamlFile, &_secretMap)
-	if err != nil {
-		zap.S().Errorf("Unmarshal: %v", err)
+	return ParseMapData(yamlFile)
+}
+
+func ParseMapData(yamlFile []byte) (SecretMap, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(yamlFile, &root); err != nil {
+		return nil, fmt.Errorf("unmarshal secret map: %w", err)
+	}
+	// an empty file may be a half written one, a map without secrets has to
+	// be spelled out as {} or `secrets: []`
+	if len(root.Content) == 0 {
+		return nil, fmt.Errorf("secret map is empty")
+	}
+	doc := root.Content[0]
+	v := &validator{}
+	if doc.Kind != yaml.MappingNode {
+		v.errorf(doc.Line, "secret map must be a mapping")
+		return nil, v.err()
+	}
+	var secrets SecretMap
+	if mappingValue(doc, "version") != nil {
+		secrets = parseMapV2(doc, v)
+	} else {
+		secrets = parseMapV1(doc, v)
 	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+func parseMapV1(doc *yaml.Node, v *validator) SecretMap {
 	var secrets = make(SecretMap)
-	for k, v := range _secretMap {
+	lines := make(map[string]int)
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		keyNode, itemsNode := doc.Content[i], doc.Content[i+1]
+		k := keyNode.Value
 		_ss := strings.Split(k, "/")
+		if len(_ss) != 2 {
+			v.errorf(keyNode.Line, "%q: key must be namespace/name", k)
+			continue
+		}
+		if line, ok := lines[k]; ok {
+			v.errorf(keyNode.Line, "%s: duplicate secret, first defined at line %d", k, line)
+			continue
+		}
+		lines[k] = keyNode.Line
 		s := Secret{
 			Namespace: _ss[0],
 			Name:      _ss[1],
-			ValuePath: v,
 		}
+		if strings.Contains(s.Name, "dockerconfigjson") {
+			s.Type = v1.SecretTypeDockerConfigJson
+		}
+		if itemsNode.Kind != yaml.SequenceNode {
+			v.errorf(itemsNode.Line, "%s: value must be a list", k)
+			continue
+		}
+		parseItems(&s, k, itemsNode.Content, v)
+		switch {
+		case s.Type != "":
+		case s.PKI != nil:
+			s.Type = v1.SecretTypeTLS
+		default:
+			s.Type = v1.SecretTypeOpaque
+		}
+		v.validateSecret(s, keyNode.Line)
 		secrets[k] = s
 	}
 	return secrets
 }
+
+func parseMapV2(doc *yaml.Node, v *validator) SecretMap {
+	v.knownFields(doc, "secret map", "version", "secrets")
+	var _secretMap _SecretMapV2
+	if err := doc.Decode(&_secretMap); err != nil {
+		v.errorf(doc.Line, "%v", err)
+		return nil
+	}
+	if _secretMap.Version != 2 {
+		v.errorf(mappingValue(doc, "version").Line, "unsupported secret map version %d", _secretMap.Version)
+		return nil
+	}
+	var secrets = make(SecretMap)
+	lines := make(map[string]int)
+	for _, node := range _secretMap.Secrets {
+		v.knownFields(&node, "secrets", "namespace", "name", "type", "labels", "annotations", "immutable", "vault_namespace", "rollout", "data")
+		var _secret _SecretV2
+		if err := node.Decode(&_secret); err != nil {
+			v.errorf(node.Line, "%v", err)
+			continue
+		}
+		k := _secret.Namespace + "/" + _secret.Name
+		if line, ok := lines[k]; ok {
+			v.errorf(node.Line, "%s: duplicate secret, first defined at line %d", k, line)
+			continue
+		}
+		lines[k] = node.Line
+		s := Secret{
+			Namespace:      _secret.Namespace,
+			Name:           _secret.Name,
+			Type:           parseType(_secret.Type),
+			Labels:         _secret.Labels,
+			Annotations:    _secret.Annotations,
+			Immutable:      _secret.Immutable,
+			VaultNamespace: _secret.VaultNamespace,
+			Rollout:        _secret.Rollout,
+		}
+		var items []*yaml.Node
+		for i := range _secret.Data {
+			items = append(items, &_secret.Data[i])
+		}
+		parseItems(&s, k, items, v)
+		if _secret.Type == "" && s.PKI != nil {
+			s.Type = v1.SecretTypeTLS
+		}
+		v.validateSecret(s, node.Line)
+		secrets[k] = s
+	}
+	return secrets
+}
+
+// parseType accepts the short names from secretTypes as well as the full
+// kubernetes type, e.g. kubernetes.io/basic-auth. Anything else is left to
+// validateSecret.
+func parseType(_type string) v1.SecretType {
+	if _type == "" {
+		return v1.SecretTypeOpaque
+	}
+	if t, ok := secretTypes[strings.ToLower(_type)]; ok {
+		return t
+	}
+	return v1.SecretType(_type)
+}
+
+func parseItems(s *Secret, k string, items []*yaml.Node, v *validator) {
+	keys := make(map[string]int)
+	for _, item := range items {
+		if item.Kind == yaml.ScalarNode && strings.HasPrefix(item.Value, "*:") {
+			from := From{Path: strings.TrimPrefix(item.Value, "*:")}
+			v.validateFrom(k, from, item.Line)
+			s.From = append(s.From, from)
+			continue
+		}
+		if item.Kind == yaml.ScalarNode {
+			if s.Type == v1.SecretTypeDockerConfigJson {
+				if _, _, _, err := parseDockerPath(item.Value); err != nil {
+					v.errorf(item.Line, "%s: %v", k, err)
+				}
+			} else if key, _, _, _, err := parseValuePath(item.Value); err != nil {
+				v.errorf(item.Line, "%s: %v", k, err)
+			} else {
+				v.validateKey(k, key, item.Line)
+				if line, ok := keys[key]; ok {
+					v.errorf(item.Line, "%s: duplicate key %q, first defined at line %d", k, key, line)
+				}
+				keys[key] = item.Line
+			}
+			s.ValuePath = append(s.ValuePath, item.Value)
+			continue
+		}
+		if item.Kind != yaml.MappingNode {
+			v.errorf(item.Line, "%s: item must be a string or a mapping", k)
+			continue
+		}
+		v.knownFields(item, k, "pki", "common_name", "alt_names", "ip_sans", "ttl", "from", "prefix", "include", "exclude", "vault_namespace", "rollout")
+		var _item _Item
+		if err := item.Decode(&_item); err != nil {
+			v.errorf(item.Line, "%s: %v", k, err)
+			continue
+		}
+		if _item.Issue == "" && _item.From.Path == "" && _item.VaultNamespace == "" && !_item.Rollout {
+			v.errorf(item.Line, "%s: item needs one of pki, from, vault_namespace or rollout", k)
+			continue
+		}
+		if _item.Issue != "" && _item.From.Path != "" {
+			v.errorf(item.Line, "%s: pki and from can't be used in one item", k)
+			continue
+		}
+		if _item.VaultNamespace != "" {
+			s.VaultNamespace = _item.VaultNamespace
+		}
+		if _item.Rollout {
+			s.Rollout = true
+		}
+		if _item.Issue != "" {
+			if s.PKI != nil {
+				v.errorf(item.Line, "%s: only one pki item is allowed", k)
+			}
+			v.validatePKI(k, _item.PKI, item.Line)
+			s.PKI = &_item.PKI
+		}
+		if _item.From.Path != "" {
+			v.validateFrom(k, _item.From, item.Line)
+			s.From = append(s.From, _item.From)
+		}
+	}
+}
+
+// mappingValue returns the value node of key in a mapping node.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// splitPath splits mount/path.
+func splitPath(p string) (string, string, error) {
+	_path := strings.SplitN(p, "/", 2)
+	if len(_path) != 2 || _path[0] == "" || strings.Trim(_path[1], "/") == "" {
+		return "", "", fmt.Errorf("%q: vault path must be mount/path", p)
+	}
+	return _path[0], _path[1], nil
+}
+
+// parseValuePath splits a `key:mount/path:vaultkey` item.
+func parseValuePath(vPath string) (key, mount, path, vaultKey string, err error) {
+	_secretPath := strings.SplitN(vPath, ":", 3)
+	if len(_secretPath) != 3 || _secretPath[0] == "" || _secretPath[2] == "" {
+		return "", "", "", "", fmt.Errorf("%q: item must be key:mount/path:vaultkey", vPath)
+	}
+	mount, path, err = splitPath(_secretPath[1])
+	if err != nil {
+		return "", "", "", "", err
+	}
+	return _secretPath[0], mount, path, _secretPath[2], nil
+}
+
+// parseDockerPath splits a `mount/path:vaultkey` dockerconfigjson item.
+func parseDockerPath(vPath string) (mount, path, vaultKey string, err error) {
+	_secretPath := strings.SplitN(vPath, ":", 2)
+	if len(_secretPath) != 2 || _secretPath[1] == "" {
+		return "", "", "", fmt.Errorf("%q: dockerconfigjson item must be mount/path:vaultkey", vPath)
+	}
+	mount, path, err = splitPath(_secretPath[0])
+	if err != nil {
+		return "", "", "", err
+	}
+	return mount, path, _secretPath[1], nil
+}
+
+// Paths returns the unique mount/path pairs the secret reads from.
+func (s Secret) Paths() []string {
+	var paths []string
+	seen := make(map[string]bool)
+	add := func(mount, path string, err error) {
+		p := mount + "/" + path
+		if err != nil || seen[p] {
+			return
+		}
+		seen[p] = true
+		paths = append(paths, p)
+	}
+	for _, from := range s.From {
+		add(splitPath(from.Path))
+	}
+	for _, vPath := range s.ValuePath {
+		if s.Type == v1.SecretTypeDockerConfigJson {
+			mount, path, _, err := parseDockerPath(vPath)
+			add(mount, path, err)
+		} else {
+			_, mount, path, _, err := parseValuePath(vPath)
+			add(mount, path, err)
+		}
+	}
+	return paths
+}
+
+// Match reports whether a vault key passes the include and exclude lists.
+// Both lists take path.Match patterns, an empty include list takes every key.
+func (f From) Match(key string) bool {
+	matchAny := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, key); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(f.Include) > 0 && !matchAny(f.Include) {
+		return false
+	}
+	return !matchAny(f.Exclude)
+}
@@ -0,0 +1,141 @@
+package vault
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"strings"
+	"testing"
+)
+
+func TestParseExampleMaps(t *testing.T) {
+	for _, file := range []string{"../../map.yaml", "../../map.v2.yaml"} {
+		secretMap, err := ParseMap(file)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if len(secretMap) == 0 {
+			t.Errorf("%s: no secrets", file)
+		}
+	}
+}
+
+func TestParseMapV1(t *testing.T) {
+	secretMap, err := ParseMapData([]byte(`
+dev/app:
+  - user:projects/dev/mysql:db_username
+  - "*:projects/dev/redis"
+  - from: projects/dev/admin
+    prefix: ADMIN_
+    exclude: ["internal_*"]
+dev/registry-dockerconfigjson:
+  - projects/dev/registry:docker
+dev/web-tls:
+  - pki: pki_int/issue/internal
+    common_name: web.dev.svc
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := secretMap["dev/app"]
+	if app.Type != v1.SecretTypeOpaque || len(app.ValuePath) != 1 || len(app.From) != 2 {
+		t.Errorf("dev/app = %+v", app)
+	}
+	if app.From[1].Prefix != "ADMIN_" || app.From[1].Match("internal_key") || !app.From[1].Match("password") {
+		t.Errorf("dev/app from = %+v", app.From[1])
+	}
+	if got := secretMap["dev/registry-dockerconfigjson"].Type; got != v1.SecretTypeDockerConfigJson {
+		t.Errorf("registry type = %s", got)
+	}
+	if tls := secretMap["dev/web-tls"]; tls.Type != v1.SecretTypeTLS || tls.PKI == nil {
+		t.Errorf("dev/web-tls = %+v", tls)
+	}
+}
+
+func TestParseMapV2(t *testing.T) {
+	secretMap, err := ParseMapData([]byte(`
+version: 2
+secrets:
+  - namespace: dev
+    name: db
+    type: basic-auth
+    immutable: true
+    labels:
+      team: backend
+    data:
+      - username:projects/dev/mysql:db_username
+      - password:projects/dev/mysql:db_password
+  - namespace: dev
+    name: custom
+    type: example.com/custom
+    vault_namespace: bu1
+    data:
+      - token:projects/dev/api:token
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := secretMap["dev/db"]
+	if db.Type != v1.SecretTypeBasicAuth || !db.Immutable || db.Labels["team"] != "backend" || len(db.ValuePath) != 2 {
+		t.Errorf("dev/db = %+v", db)
+	}
+	if custom := secretMap["dev/custom"]; custom.Type != "example.com/custom" || custom.VaultNamespace != "bu1" {
+		t.Errorf("dev/custom = %+v", custom)
+	}
+}
+
+func TestParseMapEmpty(t *testing.T) {
+	for _, data := range []string{"{}", "version: 2\nsecrets: []"} {
+		secretMap, err := ParseMapData([]byte(data))
+		if err != nil || len(secretMap) != 0 {
+			t.Errorf("%q: %v, %d secrets, want an empty map", data, err, len(secretMap))
+		}
+	}
+	if _, err := ParseMapData([]byte("  \n")); err == nil {
+		t.Error("an empty file is accepted")
+	}
+}
+
+func TestParseMapErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, data, want string
+	}{
+		{"bad key", "dev:\n  - a:projects/x:y\n", `line 1: "dev": key must be namespace/name`},
+		{"v1 duplicate secret", "dev/a:\n  - a:projects/x:y\ndev/a:\n  - b:projects/x:y\n",
+			"line 3: dev/a: duplicate secret, first defined at line 1"},
+		{"v2 duplicate secret", "version: 2\nsecrets:\n  - {namespace: dev, name: a, data: [a:projects/x:y]}\n  - {namespace: dev, name: a, data: [b:projects/x:y]}\n",
+			"line 4: dev/a: duplicate secret, first defined at line 3"},
+		{"duplicate key", "dev/a:\n  - a:projects/x:y\n  - a:projects/x:z\n", `line 3: dev/a: duplicate key "a", first defined at line 2`},
+		{"bad value path", "dev/a:\n  - a:projects:y\n", `line 2: dev/a: "projects": vault path must be mount/path`},
+		{"bad from path", "dev/a:\n  - \"*:projects\"\n", `line 2: dev/a: "projects": vault path must be mount/path`},
+		{"unknown field", "dev/a:\n  - from: projects/x\n    prefx: A_\n", `line 3: dev/a: unknown field "prefx"`},
+		{"pki without common name", "dev/a:\n  - pki: pki/issue/web\n", "line 2: dev/a: pki common_name is required"},
+		{"basic-auth key", "version: 2\nsecrets:\n  - {namespace: dev, name: a, type: basic-auth, data: [token:projects/x:y]}\n",
+			`line 3: dev/a: basic-auth only allows username and password keys, got "token"`},
+		{"no data", "dev/a: []\n", "line 1: dev/a: no data"},
+		{"bad vault namespace", "dev/a:\n  - vault_namespace: bu1//team\n  - a:projects/x:y\n", `line 1: dev/a: vault namespace "bu1//team" has an empty segment`},
+		{"version", "version: 3\nsecrets: []\n", "line 1: unsupported secret map version 3"},
+		{"unknown type", "version: 2\nsecrets:\n  - {namespace: dev, name: a, type: opaq, data: [a:projects/x:y]}\n",
+			`line 3: dev/a: unknown type "opaq", want one of basic-auth, dockerconfigjson, opaque, ssh-auth, tls or a custom type like example.com/name`},
+		{"camel case vault namespace", "version: 2\nsecrets:\n  - {namespace: dev, name: a, vaultNamespace: bu1, data: [a:projects/x:y]}\n",
+			`line 3: secrets: unknown field "vaultNamespace"`},
+	} {
+		_, err := ParseMapData([]byte(tc.data))
+		if err == nil {
+			t.Errorf("%s: map accepted", tc.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: error %q, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestErrorsFor(t *testing.T) {
+	_, err := ParseMapData([]byte("dev/a:\n  - a:projects:y\ndev/b:\n  - pki: pki/issue/web\ndev/c:\n  - c:projects/x:y\n"))
+	if got := errorsFor(err, "dev/a"); len(got) != 1 || !strings.HasPrefix(got[0], "line 2: dev/a:") {
+		t.Errorf("errors of dev/a = %q", got)
+	}
+	if got := errorsFor(err, "dev/c"); len(got) != 0 {
+		t.Errorf("errors of dev/c = %q, want none", got)
+	}
+}
@@ -0,0 +1,114 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"time"
+	"vault-injector/config"
+)
+
+var errNoMetadata = errors.New("mount has no version metadata")
+
+// mountRetry is how long the kv v2 fallback for a mount which could not be
+// detected is used before detection is tried again.
+const mountRetry = time.Minute
+
+type mountInfo struct {
+	Type      string
+	KVVersion int
+	// retryAt is set for a fallback, detected mounts are kept for good.
+	retryAt time.Time
+}
+
+// parseKVVersions reads the VAULT_KV_VERSIONS override, e.g. "legacy:1,projects:2".
+// Mounts in a non default vault namespace are prefixed with it: "bu1/legacy:1".
+func parseKVVersions(cfg *config.Config) map[string]mountInfo {
+	mounts := make(map[string]mountInfo)
+	for _, item := range strings.Split(cfg.VaultKVVersions, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		_item := strings.SplitN(item, ":", 2)
+		if len(_item) != 2 {
+			zap.S().Errorf("wrong kv version override %q, expected mount:version", item)
+			continue
+		}
+		version, err := strconv.Atoi(_item[1])
+		if err != nil || (version != 1 && version != 2) {
+			zap.S().Errorf("wrong kv version override %q, version must be 1 or 2", item)
+			continue
+		}
+		mounts[strings.Trim(_item[0], "/")] = mountInfo{Type: "kv", KVVersion: version}
+	}
+	return mounts
+}
+
+// getMount returns the engine type and kv version of a mount. Overrides from
+// config win, then sys/mounts, then the per-mount preflight endpoint which is
+// readable by any token that has access to the mount. When both fail, kv v2
+// is used for mountRetry. Detection runs without mountsLock, so one slow
+// mount doesn't hold up reads of others.
+func (v *vaultService) getMount(ctx context.Context, mount string) mountInfo {
+	key := nsPath(getNamespace(ctx), mount)
+	v.mountsLock.Lock()
+	info, ok := v.mounts[key]
+	v.mountsLock.Unlock()
+	if ok && (info.retryAt.IsZero() || time.Now().Before(info.retryAt)) {
+		return info
+	}
+	info, err := v.detectMount(ctx, mount)
+	if err != nil {
+		zap.S().Warnf("unable to detect mount %s, fallback to kv v2 for %s: %v", key, mountRetry, err)
+		info = mountInfo{Type: "kv", KVVersion: 2, retryAt: time.Now().Add(mountRetry)}
+	} else {
+		zap.S().Infof("mount %s detected: %s v%d", key, info.Type, info.KVVersion)
+	}
+	v.mountsLock.Lock()
+	v.mounts[key] = info
+	v.mountsLock.Unlock()
+	return info
+}
+
+func (v *vaultService) detectMount(ctx context.Context, mount string) (mountInfo, error) {
+	client := v.clientFor(ctx)
+	mountList, err := client.Sys().ListMountsWithContext(ctx)
+	if err == nil {
+		if m, ok := mountList[mount+"/"]; ok {
+			return newMountInfo(m.Type, m.Options["version"]), nil
+		}
+		return mountInfo{}, fmt.Errorf("mount %s not found", mount)
+	}
+	zap.S().Debugf("list mounts: %v", err)
+	secret, err := client.Logical().ReadWithContext(ctx, "sys/internal/ui/mounts/"+mount)
+	if err != nil {
+		return mountInfo{}, err
+	}
+	if secret == nil || secret.Data == nil {
+		return mountInfo{}, fmt.Errorf("mount %s not found", mount)
+	}
+	mountType, _ := secret.Data["type"].(string)
+	var version string
+	if options, ok := secret.Data["options"].(map[string]interface{}); ok {
+		version, _ = options["version"].(string)
+	}
+	return newMountInfo(mountType, version), nil
+}
+
+func newMountInfo(mountType, version string) mountInfo {
+	info := mountInfo{Type: mountType}
+	switch {
+	case mountType == "generic":
+		info.Type = "kv"
+		info.KVVersion = 1
+	case mountType == "kv" && version == "2":
+		info.KVVersion = 2
+	case mountType == "kv":
+		info.KVVersion = 1
+	}
+	return info
+}
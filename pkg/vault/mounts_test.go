@@ -0,0 +1,160 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mountsVault lists the mounts in sys/mounts, or only answers the preflight
+// endpoint when listing is denied, and serves KV v1 data.
+type mountsVault struct {
+	mounts   map[string]map[string]interface{}
+	denyList bool
+	data     map[string]map[string]interface{}
+	requests int
+	sync.Mutex
+}
+
+func (f *mountsVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests++
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	var data interface{}
+	switch {
+	case path == "sys/mounts":
+		if f.denyList {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		mounts := make(map[string]interface{})
+		for mount, info := range f.mounts {
+			mounts[mount+"/"] = info
+		}
+		data = mounts
+	case strings.HasPrefix(path, "sys/internal/ui/mounts/"):
+		info, ok := f.mounts[strings.TrimPrefix(path, "sys/internal/ui/mounts/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		data = info
+	default:
+		d, ok := f.data[path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		data = d
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data}) //nolint:errcheck
+}
+
+func (f *mountsVault) count() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.requests
+}
+
+func kvMount(version string) map[string]interface{} {
+	return map[string]interface{}{"type": "kv", "options": map[string]interface{}{"version": version}}
+}
+
+func TestDetectMount(t *testing.T) {
+	mounts := map[string]map[string]interface{}{
+		"legacy":   kvMount("1"),
+		"projects": kvMount("2"),
+		"old":      {"type": "generic"},
+		"database": {"type": "database"},
+	}
+	want := map[string]mountInfo{
+		"legacy":   {Type: "kv", KVVersion: 1},
+		"projects": {Type: "kv", KVVersion: 2},
+		"old":      {Type: "kv", KVVersion: 1},
+		"database": {Type: "database"},
+	}
+	for _, denyList := range []bool{false, true} {
+		v := newTestService(t, &mountsVault{mounts: mounts, denyList: denyList})
+		for mount, info := range want {
+			if got := v.getMount(context.Background(), mount); got != info {
+				t.Errorf("list denied %t: %s detected as %+v, want %+v", denyList, mount, got, info)
+			}
+		}
+	}
+}
+
+func TestMountFallbackRetried(t *testing.T) {
+	fake := &mountsVault{}
+	v := newTestService(t, fake)
+	info := v.getMount(context.Background(), "legacy")
+	if info.Type != "kv" || info.KVVersion != 2 {
+		t.Fatalf("fallback %+v, want kv v2", info)
+	}
+	requests := fake.count()
+	v.getMount(context.Background(), "legacy")
+	if fake.count() != requests {
+		t.Error("failed detection not cached")
+	}
+
+	fake.Lock()
+	fake.mounts = map[string]map[string]interface{}{"legacy": kvMount("1")}
+	fake.Unlock()
+	v.mountsLock.Lock()
+	v.mounts["legacy"] = mountInfo{Type: "kv", KVVersion: 2, retryAt: time.Now().Add(-time.Second)}
+	v.mountsLock.Unlock()
+	if info := v.getMount(context.Background(), "legacy"); info.KVVersion != 1 {
+		t.Errorf("%+v after the fallback expired, want kv v1", info)
+	}
+}
+
+func TestMountDetectionDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	v := newTestService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		http.NotFound(w, r)
+	}))
+	defer close(release)
+	v.mounts["legacy"] = mountInfo{Type: "kv", KVVersion: 1}
+	go v.getMount(context.Background(), "slow")
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan mountInfo)
+	go func() { done <- v.getMount(context.Background(), "legacy") }()
+	select {
+	case info := <-done:
+		if info.KVVersion != 1 {
+			t.Errorf("legacy %+v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("known mount waited for the detection of another")
+	}
+}
+
+func TestReadKVv1(t *testing.T) {
+	fake := &mountsVault{
+		mounts: map[string]map[string]interface{}{"legacy": kvMount("1")},
+		data:   map[string]map[string]interface{}{"legacy/dev/db": {"password": "secret"}},
+	}
+	v := newTestService(t, fake)
+	secretMap, err := ParseMapData([]byte("dev/app:\n  - password:legacy/dev/db:password\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.secretMap = secretMap
+	data, err := v.GetData(context.Background(), "dev", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data["password"]) != "secret" {
+		t.Errorf("data %q", data)
+	}
+	// kv v1 keeps no versions
+	if _, err := v.readVersion(context.Background(), "legacy", "dev/db"); err != errNoMetadata {
+		t.Errorf("version of kv v1: %v", err)
+	}
+}
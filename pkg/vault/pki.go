@@ -0,0 +1,163 @@
+package vault
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"net"
+	"slices"
+	"strings"
+	"time"
+	"vault-injector/pkg/metrics"
+	"vault-injector/pkg/notify"
+)
+
+// GetTLSData returns the certificate for a kubernetes.io/tls secret. The
+// current certificate is kept until PKIRenewPercent of its lifetime has
+// passed or it no longer matches the map, then a new one is issued.
+func (v *vaultService) GetTLSData(ctx context.Context, namespace, name string, current map[string][]byte) (map[string][]byte, error) {
+	secret, ok := v.GetSecretCfg(namespace, name)
+	if !ok {
+		return nil, nil
+	}
+	if secret.PKI == nil {
+		return nil, errors.New("no pki item in secret map")
+	}
+	owner := secretID(namespace, name)
+	ctx = withNamespace(ctx, secret.VaultNamespace)
+	if cert, err := parseCertificate(current[v1.TLSCertKey]); err == nil && matchCertificate(cert, secret.PKI) {
+		renewAt := v.renewTime(cert)
+		if time.Now().Before(renewAt) {
+			v.scheduleRenew(owner, renewAt)
+			return current, nil
+		}
+		zap.S().Infof("%s certificate %s expires at %s, renew", owner, cert.Subject.CommonName, cert.NotAfter)
+	}
+	if isReadOnly(ctx) {
+		placeholder := []byte(fmt.Sprintf("<issued by %s>", secret.PKI.Issue))
+		return map[string][]byte{v1.TLSCertKey: placeholder, v1.TLSPrivateKeyKey: placeholder, "ca.crt": placeholder}, nil
+	}
+
+	data, err := v.issueCertificate(ctx, secret.PKI)
+	if err != nil {
+		info := fmt.Sprintf("%s unable to issue certificate: %v", owner, err)
+		zap.S().Error(info)
+		v.notifier.Notify(notify.Error, info)
+		return nil, err
+	}
+	cert, err := parseCertificate(data[v1.TLSCertKey])
+	if err != nil {
+		return nil, err
+	}
+	zap.S().Infof("%s certificate %s issued, serial: %s, expires at %s", owner, cert.Subject.CommonName, cert.SerialNumber, cert.NotAfter)
+	v.scheduleRenew(owner, v.renewTime(cert))
+	return data, nil
+}
+
+func (v *vaultService) issueCertificate(ctx context.Context, pki *PKI) (map[string][]byte, error) {
+	request := map[string]interface{}{
+		"common_name": pki.CommonName,
+	}
+	if len(pki.AltNames) > 0 {
+		request["alt_names"] = strings.Join(pki.AltNames, ",")
+	}
+	if len(pki.IPSans) > 0 {
+		request["ip_sans"] = strings.Join(pki.IPSans, ",")
+	}
+	if pki.TTL != "" {
+		request["ttl"] = pki.TTL
+	}
+	start := time.Now()
+	secret, err := v.clientFor(ctx).Logical().WriteWithContext(ctx, pki.Issue, request)
+	metrics.ObserveVault("pki_issue", start, err)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("%s: no certificate returned", pki.Issue)
+	}
+	certificate, _ := secret.Data["certificate"].(string)
+	privateKey, _ := secret.Data["private_key"].(string)
+	ca, _ := secret.Data["issuing_ca"].(string)
+	if chain, ok := secret.Data["ca_chain"].([]interface{}); ok && len(chain) > 0 {
+		var chainPem []string
+		for _, c := range chain {
+			chainPem = append(chainPem, fmt.Sprintf("%v", c))
+		}
+		ca = strings.Join(chainPem, "\n")
+	}
+	data := make(map[string][]byte)
+	data[v1.TLSCertKey] = []byte(certificate + "\n")
+	data[v1.TLSPrivateKeyKey] = []byte(privateKey + "\n")
+	data["ca.crt"] = []byte(ca + "\n")
+	return data, nil
+}
+
+func (v *vaultService) renewTime(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(lifetime * time.Duration(v.cfg.PKIRenewPercent) / 100)
+}
+
+// scheduleRenew forces an update at renewAt, so certificates are renewed on
+// time even when Interval is longer than the renew window.
+func (v *vaultService) scheduleRenew(owner string, renewAt time.Time) {
+	v.renewLock.Lock()
+	defer v.renewLock.Unlock()
+	if timer, ok := v.renewTimers[owner]; ok {
+		timer.Stop()
+	}
+	if !time.Now().Before(renewAt) {
+		delete(v.renewTimers, owner)
+		return
+	}
+	v.renewTimers[owner] = time.AfterFunc(time.Until(renewAt), func() {
+		zap.S().Infof("%s certificate renew time", owner)
+		v.forceUpdate()
+	})
+}
+
+// stopRenewTimers stops the renew timers of secrets which are gone from the map.
+func (v *vaultService) stopRenewTimers(secretMap SecretMap) {
+	owners := make(map[string]bool)
+	for _, secret := range secretMap {
+		owners[secretID(secret.Namespace, secret.Name)] = true
+	}
+	v.renewLock.Lock()
+	defer v.renewLock.Unlock()
+	for owner, timer := range v.renewTimers {
+		if !owners[owner] {
+			timer.Stop()
+			delete(v.renewTimers, owner)
+		}
+	}
+}
+
+func parseCertificate(crt []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(crt)
+	if block == nil {
+		return nil, errors.New("no pem certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// matchCertificate reports whether the certificate still has the names requested in the map.
+func matchCertificate(cert *x509.Certificate, pki *PKI) bool {
+	if cert.Subject.CommonName != pki.CommonName {
+		return false
+	}
+	for _, name := range pki.AltNames {
+		if !slices.Contains(cert.DNSNames, name) && !slices.Contains(cert.EmailAddresses, name) {
+			return false
+		}
+	}
+	for _, ip := range pki.IPSans {
+		if !slices.ContainsFunc(cert.IPAddresses, func(certIP net.IP) bool { return certIP.String() == ip }) {
+			return false
+		}
+	}
+	return true
+}
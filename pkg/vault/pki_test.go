@@ -0,0 +1,51 @@
+package vault
+
+import (
+	"context"
+	"crypto/x509"
+	v1 "k8s.io/api/core/v1"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRenewTime(t *testing.T) {
+	v := newTestService(t, nil)
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(100 * time.Hour)}
+	if got, want := v.renewTime(cert), notBefore.Add(66*time.Hour); !got.Equal(want) {
+		t.Errorf("renewTime = %s, want %s", got, want)
+	}
+}
+
+func TestStopRenewTimers(t *testing.T) {
+	v := newTestService(t, nil)
+	v.scheduleRenew("app(default)", time.Now().Add(time.Hour))
+	v.scheduleRenew("gone(default)", time.Now().Add(time.Hour))
+	v.stopRenewTimers(SecretMap{"default/app": {Namespace: "default", Name: "app"}})
+	if _, ok := v.renewTimers["gone(default)"]; ok {
+		t.Error("timer of a removed secret left running")
+	}
+	if _, ok := v.renewTimers["app(default)"]; !ok {
+		t.Error("timer of a mapped secret stopped")
+	}
+}
+
+func TestReadOnlyIssuesNoCertificate(t *testing.T) {
+	v := newTestService(t, http.NotFoundHandler())
+	secretMap, err := ParseMapData([]byte("dev/web-tls:\n  - pki: pki_int/issue/internal\n    common_name: web.dev.svc\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.secretMap = secretMap
+	data, err := v.GetTLSData(WithReadOnly(context.Background()), "dev", "web-tls", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[v1.TLSCertKey]) != "<issued by pki_int/issue/internal>" {
+		t.Errorf("tls.crt = %q, want a placeholder", data[v1.TLSCertKey])
+	}
+	if len(v.renewTimers) != 0 {
+		t.Error("renew scheduled for a placeholder")
+	}
+}
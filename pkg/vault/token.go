@@ -0,0 +1,206 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	vault "github.com/hashicorp/vault/api"
+	"go.uber.org/zap"
+	"time"
+	"vault-injector/config"
+	"vault-injector/pkg/metrics"
+)
+
+var (
+	loginBackoffMin = time.Second
+	loginBackoffMax = 5 * time.Minute
+)
+
+func vaultLogin(ctx context.Context, cfg *config.Config) (*vault.Client, *vault.Secret, error) {
+	vaultConfig := vault.DefaultConfig()
+	vaultConfig.Address = cfg.VaultAddr
+	vaultConfig.Timeout = 60 * time.Second
+	client, err := vault.NewClient(vaultConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can`t create vault client: %w", err)
+	}
+	if cfg.VaultNamespace != "" {
+		client.SetNamespace(cfg.VaultNamespace)
+	}
+
+	authMethod, err := newAuthMethod(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to initialize %s auth method: %w", cfg.VaultAuth.Method, err)
+	}
+
+	start := time.Now()
+	authInfo, err := client.Auth().Login(ctx, authMethod)
+	metrics.ObserveVault("login", start, err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to log in with %s auth: %w", cfg.VaultAuth.Method, err)
+	}
+	if authInfo == nil || authInfo.Auth == nil {
+		return nil, nil, errors.New("no auth info was returned after login")
+	}
+	return client, authInfo, nil
+}
+
+// getClient returns the current client. The client is replaced as a whole on
+// re-login, callers never see a half-updated one.
+func (v *vaultService) getClient() *vault.Client {
+	v.clientLock.RLock()
+	defer v.clientLock.RUnlock()
+	return v.client
+}
+
+func (v *vaultService) setClient(client *vault.Client, clientSecret *vault.Secret) {
+	v.clientLock.Lock()
+	defer v.clientLock.Unlock()
+	v.client = client
+	v.clientSecret = clientSecret
+	v.setTokenTTL(clientSecret.Auth.LeaseDuration)
+}
+
+// setTokenTTL must be called with clientLock held.
+func (v *vaultService) setTokenTTL(ttl int) {
+	if ttl == 0 {
+		v.tokenExpire = time.Time{}
+		return
+	}
+	v.tokenExpire = time.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+// manageToken keeps the token alive with a lifetime watcher. When the token
+// can't be renewed any more it logs in again, retrying with exponential
+// backoff, and swaps the client.
+func (v *vaultService) manageToken(ctx context.Context) {
+	zap.S().Info("vault started")
+	for {
+		v.clientLock.RLock()
+		client, clientSecret := v.client, v.clientSecret
+		v.clientLock.RUnlock()
+		if clientSecret.Auth.LeaseDuration == 0 {
+			zap.S().Info("vault token has no ttl, renewal disabled")
+			return
+		}
+		watcher, err := client.NewLifetimeWatcher(&vault.LifetimeWatcherInput{Secret: clientSecret})
+		if err != nil {
+			zap.S().Errorf("vault token watcher: %v", err)
+		} else {
+			go watcher.Start()
+			if !v.watchToken(ctx, watcher) {
+				return
+			}
+		}
+		if !v.relogin(ctx) {
+			return
+		}
+	}
+}
+
+// watchToken logs every renewal and returns true when the token has to be
+// replaced, false when ctx is done.
+func (v *vaultService) watchToken(ctx context.Context, watcher *vault.LifetimeWatcher) bool {
+	defer watcher.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			zap.S().Info("finish main context")
+			return false
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				zap.S().Errorf("vault token renew failed: %v", err)
+			}
+			zap.S().Infof("vault token can't be renewed, ttl left: %s", v.TokenTTL())
+			return true
+		case renewal := <-watcher.RenewCh():
+			// a token with a ttl never renews to no ttl, keep the old expiry
+			if renewal.Secret.Auth.LeaseDuration > 0 {
+				v.clientLock.Lock()
+				v.setTokenTTL(renewal.Secret.Auth.LeaseDuration)
+				v.clientLock.Unlock()
+			}
+			zap.S().Infof("vault token renewed, ttl: %s", v.TokenTTL())
+		}
+	}
+}
+
+// relogin logs in until it gets a new token. A login returning the token in
+// use, a static token of the token auth method, only updates its ttl and is
+// retried with backoff until the token is replaced or it fails as expired.
+func (v *vaultService) relogin(ctx context.Context) bool {
+	backoff := loginBackoffMin
+	for {
+		client, clientSecret, err := vaultLogin(ctx, v.cfg)
+		if ctx.Err() != nil {
+			return false
+		}
+		v.clientLock.Lock()
+		v.loginErr = err
+		oldToken := v.clientSecret.Auth.ClientToken
+		same := err == nil && clientSecret.Auth.ClientToken == oldToken
+		if same {
+			v.setTokenTTL(clientSecret.Auth.LeaseDuration)
+		}
+		v.clientLock.Unlock()
+		switch {
+		case same:
+			zap.S().Warnf("vault login returned the same token, ttl left: %s, retry in %s", v.TokenTTL(), backoff)
+		case err == nil:
+			v.setClient(client, clientSecret)
+			zap.S().Infof("vault login success. duration: %d", clientSecret.Auth.LeaseDuration)
+			v.expireLeases(oldToken, clientSecret.Auth.ClientToken)
+			return true
+		default:
+			zap.S().Errorf("vault login failed, retry in %s: %v", backoff, err)
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, loginBackoffMax)
+	}
+}
+
+// Stop revokes the token when VAULT_REVOKE_TOKEN is set, together with the
+// leases of dynamic secrets issued to it. A token given with the token auth
+// method is not ours to revoke.
+func (v *vaultService) Stop(ctx context.Context) {
+	if !v.cfg.VaultAuth.RevokeToken || v.cfg.VaultAuth.Method == "token" {
+		return
+	}
+	client := v.getClient()
+	if client == nil {
+		return
+	}
+	if err := client.Auth().Token().RevokeSelfWithContext(ctx, ""); err != nil {
+		zap.S().Errorf("vault token revoke: %v", err)
+		return
+	}
+	zap.S().Info("vault token revoked")
+}
+
+// checkHealth fails while re-login fails or once the token has expired.
+func (v *vaultService) checkHealth() error {
+	v.clientLock.RLock()
+	defer v.clientLock.RUnlock()
+	if v.loginErr != nil {
+		return fmt.Errorf("login failed: %w", v.loginErr)
+	}
+	if !v.tokenExpire.IsZero() && time.Now().After(v.tokenExpire) {
+		return errors.New("token expired")
+	}
+	return nil
+}
+
+// TokenTTL returns the remaining lifetime of the vault token, zero when the
+// token does not expire.
+func (v *vaultService) TokenTTL() time.Duration {
+	v.clientLock.RLock()
+	defer v.clientLock.RUnlock()
+	if v.tokenExpire.IsZero() {
+		return 0
+	}
+	return time.Until(v.tokenExpire).Round(time.Second)
+}
@@ -0,0 +1,185 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	vault "github.com/hashicorp/vault/api"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"vault-injector/config"
+)
+
+// tokenVault answers token lookups and renewals. A zero ttl with expires set
+// is an expired token, without it a token that never expires.
+type tokenVault struct {
+	ttl     int
+	expires bool
+	renewed int
+	lookups int
+	sync.Mutex
+}
+
+func (f *tokenVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	switch r.URL.Path {
+	case "/v1/auth/token/lookup-self":
+		f.lookups++
+		var expireTime interface{}
+		if f.expires {
+			expireTime = time.Now().Add(time.Duration(f.ttl) * time.Second).Format(time.RFC3339)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+			"data": map[string]interface{}{
+				"ttl":         f.ttl,
+				"expire_time": expireTime,
+				"renewable":   true,
+				"accessor":    "accessor",
+			},
+		})
+	case "/v1/auth/token/renew-self":
+		f.renewed++
+		json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+			"auth": map[string]interface{}{
+				"client_token":   r.Header.Get("X-Vault-Token"),
+				"lease_duration": 3600,
+				"renewable":      true,
+			},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *tokenVault) count() (lookups, renewed int) {
+	f.Lock()
+	defer f.Unlock()
+	return f.lookups, f.renewed
+}
+
+// newTokenService uses the token auth method with the token the client holds.
+func newTokenService(t *testing.T, fake *tokenVault) *vaultService {
+	t.Helper()
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	v := newTestService(t, nil)
+	v.client.SetAddress(srv.URL) //nolint:errcheck
+	v.cfg.VaultAddr = srv.URL
+	v.cfg.VaultAuth.Method = "token"
+	v.cfg.VaultAuth.Token = "test"
+	v.setClient(v.client, &vault.Secret{Auth: &vault.SecretAuth{ClientToken: "test", LeaseDuration: 60, Renewable: true}})
+	return v
+}
+
+func fastBackoff(t *testing.T) {
+	min, max := loginBackoffMin, loginBackoffMax
+	loginBackoffMin, loginBackoffMax = time.Millisecond, 4*time.Millisecond
+	t.Cleanup(func() { loginBackoffMin, loginBackoffMax = min, max })
+}
+
+func TestTokenAuthTTL(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		fake        *tokenVault
+		want        int
+		wantExpired bool
+	}{
+		{"expiring", &tokenVault{ttl: 30, expires: true}, 30, false},
+		{"no ttl", &tokenVault{}, 0, false},
+		{"expired", &tokenVault{expires: true}, 0, true},
+	} {
+		v := newTokenService(t, tc.fake)
+		_, secret, err := vaultLogin(context.Background(), v.cfg)
+		if tc.wantExpired {
+			if err == nil {
+				t.Errorf("%s: logged in with an expired token", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if secret.Auth.ClientToken != "test" || secret.Auth.LeaseDuration != tc.want {
+			t.Errorf("%s: auth %+v, want ttl %d", tc.name, secret.Auth, tc.want)
+		}
+	}
+}
+
+func TestReloginKeepsSameToken(t *testing.T) {
+	fastBackoff(t)
+	fake := &tokenVault{ttl: 30, expires: true}
+	v := newTokenService(t, fake)
+	client := v.client
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if v.relogin(ctx) {
+		t.Fatal("relogin returned the token in use as a new one")
+	}
+	if lookups, _ := fake.count(); lookups < 3 {
+		t.Errorf("%d logins, want retries with backoff", lookups)
+	}
+	if v.getClient() != client {
+		t.Error("client replaced by one with the same token")
+	}
+	if ttl := v.TokenTTL(); ttl < 20*time.Second || ttl > 30*time.Second {
+		t.Errorf("ttl %s, want the one of the lookup", ttl)
+	}
+	if err := v.checkHealth(); err != nil {
+		t.Errorf("unhealthy with ttl left: %v", err)
+	}
+	if len(v.updateChan) != 0 {
+		t.Error("credentials rotated without a new token")
+	}
+}
+
+func TestReloginExpiredToken(t *testing.T) {
+	fastBackoff(t)
+	v := newTokenService(t, &tokenVault{expires: true})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if v.relogin(ctx) {
+		t.Fatal("relogin with an expired token")
+	}
+	if v.checkHealth() == nil {
+		t.Error("healthy with an expired token")
+	}
+}
+
+func TestReloginNewToken(t *testing.T) {
+	fastBackoff(t)
+	v := newTokenService(t, &tokenVault{ttl: 30, expires: true})
+	v.cfg.VaultAuth.Token = config.Password("rotated")
+	if !v.relogin(context.Background()) {
+		t.Fatal("relogin failed")
+	}
+	if got := v.getClient().Token(); got != "rotated" {
+		t.Errorf("client token %q", got)
+	}
+}
+
+func TestManageTokenRenews(t *testing.T) {
+	fake := &tokenVault{ttl: 60, expires: true}
+	v := newTokenService(t, fake)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		v.manageToken(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for v.TokenTTL() < time.Hour-time.Minute && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if _, renewed := fake.count(); renewed == 0 {
+		t.Fatal("token not renewed")
+	}
+	if ttl := v.TokenTTL(); ttl < time.Hour-time.Minute {
+		t.Errorf("ttl %s, want the renewed one", ttl)
+	}
+}
@@ -0,0 +1,169 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+)
+
+type lineError struct {
+	line int
+	msg  string
+}
+
+func (e lineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.msg)
+}
+
+// validator collects every problem of a secret map together with its line.
+type validator struct {
+	errs []lineError
+}
+
+func (v *validator) errorf(line int, format string, args ...interface{}) {
+	v.errs = append(v.errs, lineError{line: line, msg: fmt.Sprintf(format, args...)})
+}
+
+// err returns all problems ordered by line, nil for a valid map.
+func (v *validator) err() error {
+	slices.SortStableFunc(v.errs, func(a, b lineError) int { return a.line - b.line })
+	errs := make([]error, 0, len(v.errs))
+	for _, e := range v.errs {
+		errs = append(errs, e)
+	}
+	return errors.Join(errs...)
+}
+
+// errorsFor picks the problems of one secret, keyed namespace/name, out of
+// a map error.
+func errorsFor(err error, k string) []string {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return nil
+	}
+	var msgs []string
+	for _, e := range joined.Unwrap() {
+		var le lineError
+		if errors.As(e, &le) && strings.HasPrefix(le.msg, k+":") {
+			msgs = append(msgs, le.Error())
+		}
+	}
+	return msgs
+}
+
+func (v *validator) knownFields(node *yaml.Node, k string, fields ...string) {
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i < len(node.Content); i += 2 {
+		if !slices.Contains(fields, node.Content[i].Value) {
+			v.errorf(node.Content[i].Line, "%s: unknown field %q", k, node.Content[i].Value)
+		}
+	}
+}
+
+func (v *validator) validateSecret(s Secret, line int) {
+	k := s.Namespace + "/" + s.Name
+	for _, msg := range validation.IsDNS1123Label(s.Namespace) {
+		v.errorf(line, "%s: namespace %q: %s", k, s.Namespace, msg)
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(s.Name) {
+		v.errorf(line, "%s: name %q: %s", k, s.Name, msg)
+	}
+	for key, value := range s.Labels {
+		for _, msg := range validation.IsQualifiedName(key) {
+			v.errorf(line, "%s: label %q: %s", k, key, msg)
+		}
+		for _, msg := range validation.IsValidLabelValue(value) {
+			v.errorf(line, "%s: label %q value: %s", k, key, msg)
+		}
+	}
+	for key := range s.Annotations {
+		for _, msg := range validation.IsQualifiedName(key) {
+			v.errorf(line, "%s: annotation %q: %s", k, key, msg)
+		}
+	}
+	if !slices.Contains(slices.Collect(maps.Values(secretTypes)), s.Type) && !strings.Contains(string(s.Type), "/") {
+		v.errorf(line, "%s: unknown type %q, want one of %s or a custom type like example.com/name",
+			k, s.Type, strings.Join(slices.Sorted(maps.Keys(secretTypes)), ", "))
+	}
+	if s.VaultNamespace != "" && slices.Contains(strings.Split(strings.Trim(s.VaultNamespace, "/"), "/"), "") {
+		v.errorf(line, "%s: vault namespace %q has an empty segment", k, s.VaultNamespace)
+	}
+	if len(s.ValuePath) == 0 && len(s.From) == 0 && s.PKI == nil {
+		v.errorf(line, "%s: no data", k)
+		return
+	}
+
+	keys := make([]string, 0, len(s.ValuePath))
+	if s.Type != v1.SecretTypeDockerConfigJson {
+		for _, vPath := range s.ValuePath {
+			if key, _, _, _, err := parseValuePath(vPath); err == nil {
+				keys = append(keys, key)
+			}
+		}
+	}
+	switch s.Type {
+	case v1.SecretTypeDockerConfigJson:
+		if len(s.ValuePath) != 1 || len(s.From) > 0 || s.PKI != nil {
+			v.errorf(line, "%s: dockerconfigjson needs exactly one mount/path:vaultkey item", k)
+		}
+	case v1.SecretTypeTLS:
+		if s.PKI != nil && (len(s.ValuePath) > 0 || len(s.From) > 0) {
+			v.errorf(line, "%s: pki can't be combined with other items", k)
+		}
+		if s.PKI == nil && len(s.From) == 0 && (!slices.Contains(keys, v1.TLSCertKey) || !slices.Contains(keys, v1.TLSPrivateKeyKey)) {
+			v.errorf(line, "%s: tls needs a pki item or %s and %s keys", k, v1.TLSCertKey, v1.TLSPrivateKeyKey)
+		}
+	case v1.SecretTypeBasicAuth:
+		for _, key := range keys {
+			if key != v1.BasicAuthUsernameKey && key != v1.BasicAuthPasswordKey {
+				v.errorf(line, "%s: basic-auth only allows %s and %s keys, got %q", k, v1.BasicAuthUsernameKey, v1.BasicAuthPasswordKey, key)
+			}
+		}
+	case v1.SecretTypeSSHAuth:
+		if len(s.From) == 0 && !slices.Contains(keys, v1.SSHAuthPrivateKey) {
+			v.errorf(line, "%s: ssh-auth needs a %s key", k, v1.SSHAuthPrivateKey)
+		}
+	}
+	if s.PKI != nil && s.Type != v1.SecretTypeTLS {
+		v.errorf(line, "%s: pki item needs type tls, got %s", k, s.Type)
+	}
+}
+
+func (v *validator) validateKey(k, key string, line int) {
+	for _, msg := range validation.IsConfigMapKey(key) {
+		v.errorf(line, "%s: key %q: %s", k, key, msg)
+	}
+}
+
+func (v *validator) validateFrom(k string, from From, line int) {
+	if _, _, err := splitPath(from.Path); err != nil {
+		v.errorf(line, "%s: %v", k, err)
+	}
+	if from.Prefix != "" {
+		for _, msg := range validation.IsConfigMapKey(from.Prefix) {
+			v.errorf(line, "%s: prefix %q: %s", k, from.Prefix, msg)
+		}
+	}
+	for _, pattern := range append(slices.Clone(from.Include), from.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			v.errorf(line, "%s: pattern %q: %v", k, pattern, err)
+		}
+	}
+}
+
+func (v *validator) validatePKI(k string, pki PKI, line int) {
+	if !strings.Contains(pki.Issue, "/issue/") {
+		v.errorf(line, "%s: pki %q must be mount/issue/role", k, pki.Issue)
+	}
+	if pki.CommonName == "" {
+		v.errorf(line, "%s: pki common_name is required", k)
+	}
+}
@@ -7,16 +7,19 @@ import (
 	"fmt"
 	"github.com/fsnotify/fsnotify"
 	vault "github.com/hashicorp/vault/api"
-	auth "github.com/hashicorp/vault/api/auth/kubernetes"
 	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
 	"maps"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 	"vault-injector/config"
 	telegram "vault-injector/pkg"
+	"vault-injector/pkg/health"
+	"vault-injector/pkg/metrics"
+	"vault-injector/pkg/notify"
 )
 
 type DockerRegistryConfig struct {
@@ -32,37 +35,113 @@ type Service interface {
 	IsNeedSecret(namespaceAndName string) bool
 	GetData(ctx context.Context, namespace, name string) (map[string][]byte, error)
 	GetDockerData(ctx context.Context, namespace, name string) (map[string][]byte, error)
+	GetTLSData(ctx context.Context, namespace, name string, current map[string][]byte) (map[string][]byte, error)
+	GetVersions(ctx context.Context, namespace, name string) (map[string]int, error)
+	GetSecretCfg(namespace, name string) (Secret, bool)
+	GetMapErrors(namespace, name string) []string
 	GetSecretMap() SecretMap
+	ReloadMap() error
+	OnMapError(fn func())
+	Login(ctx context.Context) error
 	Start(ctx context.Context)
+	Stop(ctx context.Context)
 }
 
 type vaultService struct {
+	notifier     notify.Notifier
 	telegram     *telegram.Telegram
+	health       *health.Registry
+	loginErr     error
 	secretMap    SecretMap
+	mapErr       error
+	mapErrHooks  []func()
 	cfg          *config.Config
 	client       *vault.Client
 	clientSecret *vault.Secret
+	tokenExpire  time.Time
+	clientLock   sync.RWMutex
 	updateChan   chan config.UpdateInterface
+	mounts       map[string]mountInfo
+	mountsLock   sync.Mutex
+	leases       leaseStore
+	renewTimers  map[string]*time.Timer
+	renewLock    sync.Mutex
+	ctx          context.Context
 	sync.Mutex
 }
 
-func NewVaultService(cfg *config.Config, telegram *telegram.Telegram, updateChan chan config.UpdateInterface) Service {
+func NewVaultService(cfg *config.Config, notifier notify.Notifier, telegram *telegram.Telegram, updateChan chan config.UpdateInterface, health *health.Registry) Service {
+	if cfg.PKIRenewPercent < 1 || cfg.PKIRenewPercent > 99 {
+		zap.S().Fatalf("PKI_RENEW_PERCENT %d out of range 1-99", cfg.PKIRenewPercent)
+	}
+	secretMap, err := ParseMap(cfg.SecretMap)
+	if err != nil {
+		zap.S().Fatalf("secret map %s rejected:\n%v", cfg.SecretMap, err)
+	}
+	metrics.MapSecrets.Set(float64(len(secretMap)))
 	vs := &vaultService{
-		cfg:        cfg,
-		telegram:   telegram,
-		secretMap:  ParseMap(cfg.SecretMap),
-		updateChan: updateChan,
+		cfg:         cfg,
+		notifier:    notifier,
+		telegram:    telegram,
+		health:      health,
+		secretMap:   secretMap,
+		updateChan:  updateChan,
+		mounts:      parseKVVersions(cfg),
+		leases:      leaseStore{items: make(map[string]*lease)},
+		renewTimers: make(map[string]*time.Timer),
+		ctx:         context.Background(),
 	}
 	return vs
 }
 
+// setSecretMap reloads the map on file changes.
 func (v *vaultService) setSecretMap() {
+	v.ReloadMap() //nolint:errcheck
+}
+
+// ReloadMap reads the map again and forces an update. A map with errors is
+// rejected, returned, and the last good one stays active.
+func (v *vaultService) ReloadMap() error {
+	secretMap, err := ParseMap(v.cfg.SecretMap)
+	if err != nil {
+		info := fmt.Sprintf("secret map %s rejected, keep the last good one:\n%v", v.cfg.SecretMap, err)
+		zap.S().Error(info)
+		v.notifier.Notify(notify.Error, info)
+		v.Lock()
+		v.mapErr = err
+		hooks := slices.Clone(v.mapErrHooks)
+		v.Unlock()
+		for _, fn := range hooks {
+			fn()
+		}
+		return err
+	}
+	v.Lock()
+	v.secretMap = secretMap
+	v.mapErr = nil
+	v.Unlock()
+	metrics.MapSecrets.Set(float64(len(secretMap)))
+	v.releaseLeases(secretMap)
+	v.stopRenewTimers(secretMap)
+	v.forceUpdate()
+	return nil
+}
+
+// OnMapError registers fn to run each time a map is rejected, once
+// GetMapErrors returns its problems.
+func (v *vaultService) OnMapError(fn func()) {
 	v.Lock()
 	defer v.Unlock()
-	v.secretMap = ParseMap(v.cfg.SecretMap)
-	u := config.UpdateInterface(true)
-	v.updateChan <- u
-	return
+	v.mapErrHooks = append(v.mapErrHooks, fn)
+}
+
+// forceUpdate asks the loop for a reconcile. The loop runs on the leader only,
+// so the send never blocks, a request already waiting covers this one.
+func (v *vaultService) forceUpdate() {
+	select {
+	case v.updateChan <- config.UpdateInterface(true):
+	default:
+	}
 }
 
 func (v *vaultService) IsNeedSecret(namespaceAndName string) bool {
@@ -72,6 +151,14 @@ func (v *vaultService) IsNeedSecret(namespaceAndName string) bool {
 	return ok
 }
 
+// GetMapErrors returns the problems of the last rejected map that belong to
+// the secret, nil while the loaded map is current.
+func (v *vaultService) GetMapErrors(namespace, name string) []string {
+	v.Lock()
+	defer v.Unlock()
+	return errorsFor(v.mapErr, namespace+"/"+name)
+}
+
 func (v *vaultService) GetSecretCfg(namespace, name string) (Secret, bool) {
 	v.Lock()
 	defer v.Unlock()
@@ -92,14 +179,51 @@ func (v *vaultService) GetData(ctx context.Context, namespace, name string) (map
 	}
 	data := make(map[string][]byte)
 	errFlag := false
+	// a key may come from one item only, a from expansion must not silently
+	// replace an explicit key or the keys of another path
+	sources := make(map[string]string)
+	var collisions []string
+	setKey := func(key, source string) bool {
+		if first, ok := sources[key]; ok {
+			collisions = append(collisions, fmt.Sprintf("%q from %s and %s", key, first, source))
+			return false
+		}
+		sources[key] = source
+		return true
+	}
+	ctx = context.WithValue(ctx, "secret", secretID(namespace, name))
+	ctx = withNamespace(ctx, secret.VaultNamespace)
+	for _, from := range secret.From {
+		mount, path, err := splitPath(from.Path)
+		if err != nil {
+			errFlag = true
+			continue
+		}
+		pathData, err := v.GetVaultPath(ctx, mount, path)
+		if errors.Is(err, errReadOnly) {
+			data[from.Prefix+"*"] = []byte(fmt.Sprintf("<keys of the lease of %s>", from.Path))
+			continue
+		}
+		if err != nil {
+			errFlag = true
+			continue
+		}
+		for vaultKey, value := range pathData {
+			if from.Match(vaultKey) && setKey(from.Prefix+vaultKey, "*:"+from.Path) {
+				data[from.Prefix+vaultKey] = []byte(fmt.Sprintf("%v", value))
+			}
+		}
+	}
 	for _, vPath := range secret.ValuePath {
-		_secretPath := strings.SplitN(vPath, ":", 3)
-		_path := strings.SplitN(_secretPath[1], "/", 2)
-		key := _secretPath[0]
-		mount := _path[0]
-		path := _path[1]
-		vaultKey := _secretPath[2]
-		ctx = context.WithValue(ctx, "secret", name+"("+namespace+")")
+		key, mount, path, vaultKey, err := parseValuePath(vPath)
+		if err != nil {
+			zap.S().Errorf("%s: %v", secretID(namespace, name), err)
+			errFlag = true
+			continue
+		}
+		if !setKey(key, vPath) {
+			continue
+		}
 		secretData, err := v.GetVaultSecret(ctx, mount, path, vaultKey)
 		if err != nil {
 			data[key] = []byte{}
@@ -107,6 +231,11 @@ func (v *vaultService) GetData(ctx context.Context, namespace, name string) (map
 		}
 		data[key] = secretData
 	}
+	if len(collisions) > 0 {
+		err := fmt.Errorf("keys defined twice: %s", strings.Join(collisions, ", "))
+		zap.S().Errorf("%s: %v", secretID(namespace, name), err)
+		return data, err
+	}
 	if errFlag {
 		return data, errors.New("get secret error")
 	}
@@ -118,13 +247,15 @@ func (v *vaultService) GetDockerData(ctx context.Context, namespace, name string
 	if !ok {
 		return nil, nil
 	}
-	vPath := secret.ValuePath[0]
-	_secretPath := strings.SplitN(vPath, ":", 2)
-	_path := strings.SplitN(_secretPath[0], "/", 2)
-	mount := _path[0]
-	path := _path[1]
-	vaultKey := _secretPath[1]
-	ctx = context.WithValue(ctx, "secret", name+"("+namespace+")")
+	if len(secret.ValuePath) == 0 {
+		return nil, errors.New("no dockerconfigjson item in secret map")
+	}
+	mount, path, vaultKey, err := parseDockerPath(secret.ValuePath[0])
+	if err != nil {
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, "secret", secretID(namespace, name))
+	ctx = withNamespace(ctx, secret.VaultNamespace)
 	host, err := v.GetVaultSecret(ctx, mount, path, vaultKey+"/host")
 	if err != nil {
 		return nil, err
@@ -151,6 +282,51 @@ func (v *vaultService) GetDockerData(ctx context.Context, namespace, name string
 	return data, nil
 }
 
+// GetVersions returns the KV v2 version of every path the secret is built
+// from. Paths whose data was read with the read cache of ctx report the
+// version of that data, the others the current version from the metadata
+// endpoint, their data stays in vault.
+func (v *vaultService) GetVersions(ctx context.Context, namespace, name string) (map[string]int, error) {
+	secret, ok := v.GetSecretCfg(namespace, name)
+	if !ok {
+		return nil, nil
+	}
+	if secret.PKI != nil {
+		return nil, errNoMetadata
+	}
+	ctx = withNamespace(ctx, secret.VaultNamespace)
+	versions := make(map[string]int)
+	for _, p := range secret.Paths() {
+		mount, path, _ := splitPath(p) //nolint:errcheck
+		version, err := v.readVersion(ctx, mount, path)
+		if err != nil {
+			zap.S().Debugf("%s(%s) get metadata %s: %v", name, namespace, p, err)
+			return nil, err
+		}
+		versions[p] = version
+	}
+	return versions, nil
+}
+
+func (v *vaultService) readVersion(ctx context.Context, mount, path string) (int, error) {
+	if info := v.getMount(ctx, mount); info.Type != "kv" || info.KVVersion == 1 {
+		return 0, errNoMetadata
+	}
+	cache := getReadCache(ctx)
+	cacheKey := nsPath(getNamespace(ctx), mount+"/"+path)
+	if version, ok := cache.getVersion(ctx, cacheKey); ok {
+		return version, nil
+	}
+	start := time.Now()
+	metadata, err := v.clientFor(ctx).KVv2(mount).GetMetadata(ctx, path)
+	metrics.ObserveVault("kv_metadata", start, err)
+	if err != nil {
+		return 0, err
+	}
+	cache.setVersion(cacheKey, metadata.CurrentVersion)
+	return metadata.CurrentVersion, nil
+}
+
 func (v *vaultService) GetVaultSecret(ctx context.Context, mount, path, key string) ([]byte, error) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -158,67 +334,135 @@ func (v *vaultService) GetVaultSecret(ctx context.Context, mount, path, key stri
 		}
 	}()
 	secretName := ctx.Value("secret").(string)
-	secret, err := v.client.KVv2(mount).Get(ctx, path)
 	zap.S().Debugf("%s getKV %s/%s:%s", secretName, mount, path, key)
+	data, err := v.GetVaultPath(ctx, mount, path)
+	if errors.Is(err, errReadOnly) {
+		return []byte(fmt.Sprintf("<lease of %s/%s>", mount, path)), nil
+	}
 	if err != nil {
-		info := fmt.Sprintf("unable to read secret: %v", err)
-		zap.S().Error(info)
-		v.telegram.SendMessage(info)
 		return nil, err
 	}
-	s := secret.Data[key]
+	s := data[key]
 	return []byte(fmt.Sprintf("%v", s)), nil
 }
 
-func vaultLogin(ctx context.Context, cfg *config.Config) (*vault.Client, *vault.Secret) {
-	vaultConfig := vault.DefaultConfig()
-	vaultConfig.Address = cfg.VaultAddr
-	vaultConfig.Timeout = 60 * time.Second
-	client, err := vault.NewClient(vaultConfig)
+// GetVaultPath returns every key of a vault path.
+func (v *vaultService) GetVaultPath(ctx context.Context, mount, path string) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	var err error
+	if v.getMount(ctx, mount).Type == "kv" {
+		data, err = v.readKV(ctx, mount, path)
+	} else {
+		data, err = v.readDynamic(ctx, mount, path)
+	}
+	if errors.Is(err, errReadOnly) {
+		return nil, err
+	}
 	if err != nil {
-		zap.S().Fatalf("can`t create vault client: %v", err)
+		info := fmt.Sprintf("unable to read secret: %v", err)
+		zap.S().Error(info)
+		v.notifier.Notify(notify.Error, info)
+		return nil, err
+	}
+	return data, nil
+}
 
+func secretID(namespace, name string) string {
+	return name + "(" + namespace + ")"
+}
+
+type namespaceCtxKey struct{}
+
+// withNamespace sets the vault namespace used by reads made with ctx. The
+// namespace is a child of VAULT_NAMESPACE, an empty one keeps the default.
+func withNamespace(ctx context.Context, namespace string) context.Context {
+	if namespace == "" {
+		return ctx
 	}
+	return context.WithValue(ctx, namespaceCtxKey{}, namespace)
+}
 
-	k8sAuth, err := auth.NewKubernetesAuth(
-		cfg.VaultRole,
-		auth.WithServiceAccountTokenPath(cfg.TokenPath))
+type readOnlyCtxKey struct{}
 
-	if err != nil {
-		zap.S().Fatalf("unable to initialize Kubernetes auth method: %v", err)
-		return nil, nil
+var errReadOnly = errors.New("read only, no lease taken")
+
+// WithReadOnly marks reads made with ctx as free of side effects: dynamic
+// secrets are not leased and certificates are not issued, placeholders stand
+// in for their values.
+func WithReadOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readOnlyCtxKey{}, true)
+}
+
+func isReadOnly(ctx context.Context) bool {
+	readOnly, _ := ctx.Value(readOnlyCtxKey{}).(bool)
+	return readOnly
+}
+
+func getNamespace(ctx context.Context) string {
+	namespace, _ := ctx.Value(namespaceCtxKey{}).(string)
+	return namespace
+}
+
+func nsPath(namespace, path string) string {
+	if namespace == "" {
+		return path
 	}
+	return strings.Trim(namespace, "/") + "/" + path
+}
 
-	authInfo, err := client.Auth().Login(ctx, k8sAuth)
-	if err != nil {
-		zap.S().Fatalf("una111ble to log in with Kubernetes auth: %v", err)
-		return nil, nil
+// clientFor returns the client bound to the vault namespace from ctx.
+func (v *vaultService) clientFor(ctx context.Context) *vault.Client {
+	client := v.getClient()
+	if namespace := getNamespace(ctx); namespace != "" {
+		return client.WithNamespace(nsPath(v.cfg.VaultNamespace, strings.Trim(namespace, "/")))
 	}
-	if authInfo == nil {
-		zap.S().Fatalf("no auth info was returned after login")
-		return nil, nil
+	return client
+}
+
+func (v *vaultService) readKV(ctx context.Context, mount, path string) (map[string]interface{}, error) {
+	cacheKey := nsPath(getNamespace(ctx), mount+"/"+path)
+	return getReadCache(ctx).fetch(ctx, cacheKey, func() (map[string]interface{}, int, error) {
+		var secret *vault.KVSecret
+		var err error
+		start := time.Now()
+		if v.getMount(ctx, mount).KVVersion == 1 {
+			secret, err = v.clientFor(ctx).KVv1(mount).Get(ctx, path)
+		} else {
+			secret, err = v.clientFor(ctx).KVv2(mount).Get(ctx, path)
+		}
+		metrics.ObserveVault("kv_read", start, err)
+		if err != nil {
+			return nil, 0, err
+		}
+		version := 0
+		if secret.VersionMetadata != nil {
+			version = secret.VersionMetadata.Version
+		}
+		return secret.Data, version, nil
+	})
+}
+
+// Login logs in to vault without starting token renewal or the map watcher.
+func (v *vaultService) Login(ctx context.Context) error {
+	v.ctx = ctx
+	client, clientSecret, err := vaultLogin(ctx, v.cfg)
+	if err != nil {
+		return err
 	}
-	return client, authInfo
+	v.setClient(client, clientSecret)
+	zap.S().Infof("vault login success. duration: %d", clientSecret.Auth.LeaseDuration)
+	return nil
 }
 
 func (v *vaultService) Start(ctx context.Context) {
-	v.client, v.clientSecret = vaultLogin(ctx, v.cfg)
+	if err := v.Login(ctx); err != nil {
+		zap.S().Fatal(err)
+	}
+	metrics.RegisterTokenTTL(v.TokenTTL)
+	v.health.Register("vault", health.Readiness, v.checkHealth)
 	v.initTelegram(ctx)
-	zap.S().Infof("vault login success. duration: %d", v.clientSecret.Auth.LeaseDuration)
-	go func() {
-		zap.S().Info("vault started")
-		ticker := time.NewTicker(time.Second*time.Duration(v.clientSecret.Auth.LeaseDuration) - 10*time.Second)
-		for {
-			select {
-			case <-ctx.Done():
-				zap.S().Info("finish main context")
-				return
-			case _ = <-ticker.C:
-				v.client, v.clientSecret = vaultLogin(ctx, v.cfg)
-			}
-		}
-	}()
 	go configWatcher(v)
+	go v.manageToken(ctx)
 }
 
 func (v *vaultService) initTelegram(ctx context.Context) {
@@ -228,16 +472,15 @@ func (v *vaultService) initTelegram(ctx context.Context) {
 		}
 	}()
 
-	secret, err := v.client.KVv2("projects").Get(ctx, "share/telegram")
+	data, err := v.readKV(ctx, "projects", "share/telegram")
 	zap.S().Debugf("%s getKV %s/%s", "telegram", "projects", "share/telegram")
 	if err != nil {
 		info := fmt.Sprintf("Init telegram failed: %v", err)
 		zap.S().Error(info)
 		return
 	}
-	ChatID, _ := strconv.ParseInt(secret.Data["channel"].(string), 10, 0)
-	v.telegram.ChatID = ChatID
-	v.telegram.Token = config.Password(secret.Data["token"].(string))
+	ChatID, _ := strconv.ParseInt(data["channel"].(string), 10, 0)
+	v.telegram.SetCredentials(ChatID, config.Password(data["token"].(string)))
 	zap.S().Info("Telegram initialized")
 }
 
@@ -0,0 +1,123 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientForNestsNamespace(t *testing.T) {
+	v := newTestService(t, nil)
+	for _, tc := range []struct {
+		root, entry, want string
+	}{
+		{"", "", ""},
+		{"", "bu1", "bu1"},
+		{"admin", "bu1", "admin/bu1"},
+		{"admin/", "/bu1/team", "admin/bu1/team"},
+	} {
+		v.cfg.VaultNamespace = tc.root
+		ctx := withNamespace(context.Background(), tc.entry)
+		if got := v.clientFor(ctx).Namespace(); got != tc.want {
+			t.Errorf("root %q entry %q: namespace %q, want %q", tc.root, tc.entry, got, tc.want)
+		}
+	}
+}
+
+func kvHandler(paths map[string]map[string]interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := paths[strings.TrimPrefix(r.URL.Path, "/v1/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data}) //nolint:errcheck
+	})
+}
+
+func TestGetDataKeyCollision(t *testing.T) {
+	v := newTestService(t, kvHandler(map[string]map[string]interface{}{
+		"projects/dev/mysql": {"db_password": "secret"},
+		"projects/dev/redis": {"password": "other", "host": "redis"},
+	}))
+	v.mounts["projects"] = mountInfo{Type: "kv", KVVersion: 1}
+	for _, tc := range []struct {
+		name, data string
+		collision  bool
+	}{
+		{"explicit and from", "dev/app:\n  - password:projects/dev/mysql:db_password\n  - \"*:projects/dev/redis\"\n", true},
+		{"two froms", "dev/app:\n  - \"*:projects/dev/redis\"\n  - from: projects/dev/redis\n    include: [host]\n", true},
+		{"prefixed", "dev/app:\n  - password:projects/dev/mysql:db_password\n  - from: projects/dev/redis\n    prefix: REDIS_\n", false},
+	} {
+		secretMap, err := ParseMapData([]byte(tc.data))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		v.secretMap = secretMap
+		data, err := v.GetData(context.Background(), "dev", "app")
+		if tc.collision {
+			if err == nil || !strings.Contains(err.Error(), "keys defined twice") {
+				t.Errorf("%s: error %v, want a key collision", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if string(data["password"]) != "secret" || string(data["REDIS_password"]) != "other" {
+			t.Errorf("%s: data %q", tc.name, data)
+		}
+	}
+}
+
+func TestForceUpdateNeverBlocks(t *testing.T) {
+	v := newTestService(t, nil)
+	done := make(chan struct{})
+	go func() {
+		// nobody reads on a follower
+		v.forceUpdate()
+		v.forceUpdate()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("forceUpdate blocked")
+	}
+	if len(v.updateChan) != 1 {
+		t.Errorf("%d updates pending, want them coalesced into 1", len(v.updateChan))
+	}
+}
+
+func TestReloadMapRunsMapErrorHooks(t *testing.T) {
+	v := newTestService(t, nil)
+	v.cfg.SecretMap = filepath.Join(t.TempDir(), "map.yaml")
+	var errs []string
+	v.OnMapError(func() { errs = v.GetMapErrors("dev", "app") })
+
+	if err := os.WriteFile(v.cfg.SecretMap, []byte("dev/app:\n  - user:projects/dev/mysql:db_username\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.ReloadMap(); err != nil {
+		t.Fatal(err)
+	}
+	if errs != nil {
+		t.Fatal("hook ran for a good map")
+	}
+
+	if err := os.WriteFile(v.cfg.SecretMap, []byte("dev/app:\n  - pki: pki_int/issue/internal\n  - user:projects/dev/mysql:db_username\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.ReloadMap(); err == nil {
+		t.Fatal("bad map accepted")
+	}
+	if len(errs) == 0 {
+		t.Error("hook did not see the errors of dev/app")
+	}
+}